@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// channel of the datasource operators publish annotations on
+const annotationsChannelPath = "annotations"
+
+// comments are meant to be a line or two, not files
+const maxAnnotationText = 4096
+
+// keep field names boring so they can not clash with getdata syntax (representations, dots, ...)
+var annotationFieldPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// grafana org roles from least to most privileged
+var grafanaRoles = map[string]int{"Viewer": 1, "Editor": 2, "Admin": 3}
+
+const defaultPublishRole = "Editor"
+
+// canPublish says if user may publish annotations with these settings
+func canPublish(settings InitSettings, user *backend.User) bool {
+	if !settings.AllowPublish || settings.AnnotationsLocation == "" || user == nil {
+		return false
+	}
+	required := settings.PublishRole
+	if required == "" {
+		required = defaultPublishRole
+	}
+	rank, found := grafanaRoles[required]
+	if !found {
+		//a typo in the settings should not open publishing up to everyone
+		return false
+	}
+	return grafanaRoles[user.Role] >= rank
+}
+
+func (req PublishRequest) validate() error {
+	if !annotationFieldPattern.MatchString(req.Field) {
+		return fmt.Errorf("annotation field %q must be letters, digits and _ and start with a letter: %w", req.Field, ErrInvalidRequest)
+	}
+	if (req.Value == nil) == (req.Text == "") {
+		return fmt.Errorf("annotation needs exactly one of value or text: %w", ErrInvalidRequest)
+	}
+	if req.Value != nil && (math.IsNaN(*req.Value) || math.IsInf(*req.Value, 0)) {
+		return fmt.Errorf("annotation value must be finite: %w", ErrInvalidRequest)
+	}
+	if len(req.Text) > maxAnnotationText || !utf8.ValidString(req.Text) {
+		return fmt.Errorf("annotation text must be valid utf-8 and at most %d bytes: %w", maxAnnotationText, ErrInvalidRequest)
+	}
+	if req.Time != nil && (math.IsNaN(*req.Time) || math.IsInf(*req.Time, 0)) {
+		return fmt.Errorf("annotation time must be finite: %w", ErrInvalidRequest)
+	}
+	return nil
+}
+
+// annotationWriter owns the handle on the writable dirfile, opened on the first publish
+// it is separate from the readers so writes never go to the dirfile the acquisition writes
+type annotationWriter struct {
+	mutex  *sync.Mutex
+	path   string
+	flags  uint64
+	df     Dirfile
+	open   bool
+	closed bool
+}
+
+func newAnnotationWriter(path string, flags uint64) *annotationWriter {
+	return &annotationWriter{mutex: &sync.Mutex{}, path: path, flags: GD_open_rw_flags(flags)}
+}
+
+// dirfile gives the handle, the caller holds the mutex
+func (w *annotationWriter) dirfile() (Dirfile, error) {
+	if w.closed {
+		return Dirfile{}, fmt.Errorf("annotations dirfile is closed: %w", ErrBadDirfile)
+	}
+	if !w.open {
+		df, err := GD_open(w.path, w.flags)
+		if err != nil {
+			return Dirfile{}, err
+		}
+		w.df = df
+		w.open = true
+	}
+	return w.df, nil
+}
+
+// write appends a value to the RAW field req.Field and its time to req.Field_TIME,
+// or stores the text in a new STRING entry named after the field and the time
+func (w *annotationWriter) write(req PublishRequest, now time.Time) error {
+	defer w.mutex.Unlock()
+	w.mutex.Lock()
+
+	df, err := w.dirfile()
+	if err != nil {
+		return err
+	}
+	t := float64(now.UnixNano()) / 1e9
+	if req.Time != nil {
+		t = *req.Time
+	}
+
+	if req.Value == nil {
+		return writeComment(df, req.Field, req.Text, t)
+	}
+
+	timeField := req.Field + "_TIME"
+	for _, field := range []string{req.Field, timeField} {
+		if err := ensureRaw(df, field); err != nil {
+			return err
+		}
+	}
+	//the time goes at the same sample as the value even if the two fields somehow got out of step
+	sample, err := GD_eof(df, req.Field)
+	if err != nil {
+		return err
+	}
+	if _, err := GD_putdata(df, req.Field, sample, []float64{*req.Value}); err != nil {
+		return err
+	}
+	if _, err := GD_putdata(df, timeField, sample, []float64{t}); err != nil {
+		return err
+	}
+	if err := GD_flush(df, req.Field); err != nil {
+		return err
+	}
+	return GD_flush(df, timeField)
+}
+
+// ensureRaw adds field as a RAW field with one sample per frame unless it already is one
+func ensureRaw(df Dirfile, field string) error {
+	switch GD_entry_type(df, field) {
+	case gdRawEntry:
+		return nil
+	case gdNoEntry:
+		if err := GD_add_raw(df, field, 1); err != nil {
+			return err
+		}
+		return GD_metaflush(df)
+	default:
+		return fmt.Errorf("annotation field %s exists and is not RAW: %w", field, ErrBadFieldType)
+	}
+}
+
+// writeComment stores text as the STRING entry field_<unix ms>, with a counter after it
+// when two comments land in the same millisecond
+func writeComment(df Dirfile, field, text string, t float64) error {
+	base := field + "_" + strconv.FormatInt(int64(math.Round(t*1000)), 10)
+	name := base
+	for i := 1; GD_entry_type(df, name) != gdNoEntry; i++ {
+		name = base + "_" + strconv.Itoa(i)
+	}
+	if err := GD_add_string(df, name, text); err != nil {
+		return err
+	}
+	return GD_metaflush(df)
+}
+
+func (w *annotationWriter) close() {
+	defer w.mutex.Unlock()
+	w.mutex.Lock()
+
+	if w.open {
+		GD_close(w.df)
+		w.open = false
+	}
+	w.closed = true
+}
@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// a backfill never sends more points than this, however long the subscriber was gone
+const streamBackfillMaxPoints = 10000
+
+// backfill builds the frame with what was written since the position a subscriber resumes from
+// it goes out as the initial data of that subscription only, the other subscribers of the channel
+// already have it. returns the frame the backfill reaches up to, or -1 if there is nothing to backfill
+func (d *Datasource) backfill(ctx context.Context, df Dirfile, sr StreamRequest, raw json.RawMessage) (*backend.InitialData, int, error) {
+	if len(raw) == 0 {
+		return nil, -1, nil
+	}
+	var resume StreamResume
+	if err := json.Unmarshal(raw, &resume); err != nil {
+		return nil, -1, fmt.Errorf("bad resume position %s: %w", raw, ErrInvalidRequest)
+	}
+	if resume.LastFrame == nil && resume.LastTime == nil {
+		return nil, -1, nil
+	}
+
+	nframes := GD_nframes(df)
+	first, after, err := d.resumePosition(ctx, df, sr, resume, nframes)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	//dont let a long outage turn into a read which takes forever
+	if d.settings.MaxSamples > 0 {
+		perFrame := GD_spf(df, sr.timeName)
+		for _, name := range sr.fields() {
+			perFrame += GD_spf(df, name)
+		}
+		if perFrame > 0 && (nframes-first)*perFrame > d.settings.MaxSamples {
+			first = nframes - d.settings.MaxSamples/perFrame
+		}
+	}
+	if first >= nframes {
+		return nil, nframes, nil
+	}
+
+	//read and decimated the way the live updates are, so the points keep their spacing where the two meet
+	firstSample, spf, unixTimeSlice, columns, release, err := d.streamRead(ctx, df, sr, first, nframes)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer release()
+
+	//the frame the last point was in may have been partly sent already
+	skip := 0
+	for skip < len(unixTimeSlice) && unixTimeSlice[skip] <= after {
+		skip++
+	}
+	unixTimeSlice = unixTimeSlice[skip:]
+	for k := range columns {
+		columns[k] = columns[k][skip:]
+	}
+	if len(unixTimeSlice) == 0 {
+		return nil, nframes, nil
+	}
+
+	dc := newDecimator(d.backfillFactor(ctx, df, sr, spf, unixTimeSlice), sr.decimationMode)
+	unixTimeSlice, columns = dc.feed(firstSample+skip, unixTimeSlice, columns)
+	//the bucket which is not complete yet is left to the live updates, they carry on from its frame
+	resumeFrame := nframes
+	if spf > 0 && dc.bucket >= 0 && dc.bucket*dc.factor/spf < nframes {
+		resumeFrame = dc.bucket * dc.factor / spf
+	}
+	if len(unixTimeSlice) == 0 {
+		return nil, resumeFrame, nil
+	}
+
+	initial, err := backend.NewInitialFrame(streamFrame(sr, unixTimeSlice, columns), data.IncludeAll)
+	if err != nil {
+		return nil, -1, err
+	}
+	backend.Logger.Info(fmt.Sprintf("Backfilling %d points from frame %d", len(unixTimeSlice), first))
+	return initial, resumeFrame, nil
+}
+
+// backfillFactor is the decimation factor of the stream, or a multiple of it when that would give more
+// than streamBackfillMaxPoints points. a multiple keeps the buckets lined up with those of the live updates
+func (d *Datasource) backfillFactor(ctx context.Context, df Dirfile, sr StreamRequest, spf int, times []float64) int {
+	//without a sample rate the stream counts the samples of a tick, here that is the time the backfill covers
+	var span float64
+	if sr.indexMode != "" {
+		span = (times[len(times)-1] - times[0]) / sr.sampleRate
+	} else if sr.timeType {
+		span = toUnix(times[len(times)-1], sr.timeFormat) - toUnix(times[0], sr.timeFormat)
+	}
+	samples := len(times)
+	if span <= 0 {
+		samples, span = 0, 1
+	}
+	factor := d.streamFactor(ctx, df, sr, spf, samples, time.Duration(span*float64(time.Second)))
+	if points := len(times)/factor + 1; points > streamBackfillMaxPoints {
+		factor *= (points + streamBackfillMaxPoints - 1) / streamBackfillMaxPoints
+	}
+	return factor
+}
+
+// resumePosition turns a resume position into the first frame to send, and the time field value
+// the points have to be past (some of that frame may have been sent already)
+func (d *Datasource) resumePosition(ctx context.Context, df Dirfile, sr StreamRequest, resume StreamResume, nframes int) (int, float64, error) {
+	first := 0
+	after := math.Inf(-1)
+	switch {
+	case resume.LastFrame != nil:
+		first = *resume.LastFrame + 1
+	case sr.indexMode == "fromEndNow":
+		//index streams count back from now, so the frame comes from how long ago the last point was
+		ago := float64(time.Now().UnixMilli())/1e3 - *resume.LastTime/1e3
+		first = int(math.Floor(float64(nframes)-ago*sr.sampleRate)) + 1
+	case sr.indexMode != "":
+		//the others count from frame 0 at indexStart
+		first = int(math.Floor((*resume.LastTime/1e3-sr.indexStart)*sr.sampleRate)) + 1
+	default:
+		after = *resume.LastTime
+		if sr.timeType {
+			after = fromUnix(*resume.LastTime/1e3-sr.timeOffset, sr.timeFormat)
+		}
+		frame, err := d.frameLookup(ctx, df, sr.timeName, after)
+		if err != nil {
+			return 0, after, err
+		}
+		first = int(math.Floor(frame))
+	}
+	if first < 0 {
+		first = 0
+	}
+	return first, after, nil
+}
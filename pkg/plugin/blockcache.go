@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// frames per cached block, reads get rounded out to whole blocks
+const blockFrames = 256
+
+// default memory budget for the block cache of a datasource, can be changed in the settings
+const defaultBlockCacheMB = 32
+
+type blockKey struct {
+	dirfile string
+	field   string
+	block   int
+}
+
+type block struct {
+	key    blockKey
+	data   []float64
+	frames int // frames the block held when it was read, the tail block grows with the dirfile
+}
+
+// blockCache is an LRU cache of recently read blocks of frames
+// panels refreshing every few seconds mostly re-read the same blocks so this saves a lot of trips to getdata
+type blockCache struct {
+	mutex  *sync.Mutex
+	budget int
+	size   int
+	lru    *list.List // front is the most recently used
+	blocks map[blockKey]*list.Element
+	stats  CacheStats
+}
+
+func newBlockCache(memoryMB int) *blockCache {
+	if memoryMB == 0 {
+		memoryMB = defaultBlockCacheMB
+	}
+	return &blockCache{
+		mutex:  &sync.Mutex{},
+		budget: memoryMB * 1024 * 1024,
+		lru:    list.New(),
+		blocks: map[blockKey]*list.Element{},
+	}
+}
+
+// getdata behaves like GD_getdata_ctx but goes through the cache
+// blocks are read one at a time so a cancelled ctx stops the read at the next block
+func (c *blockCache) getdata(ctx context.Context, df Dirfile, fieldName string, firstFrame, numFrames int) ([]float64, error) {
+	if c == nil || c.budget < 0 || firstFrame < 0 {
+		return GD_getdata_ctx(ctx, fieldName, df, firstFrame, numFrames)
+	}
+
+	//same checks as GD_getdata_ctx so that the cache does not change what the callers see
+	if numFrames <= 0 {
+		return nil, fmt.Errorf("num_frames must be greater than 0: %w", ErrInvalidRequest)
+	}
+	nframes := GD_nframes(df)
+	if firstFrame >= nframes-1 {
+		return nil, fmt.Errorf("first_frame is out of bounds: %w", ErrRange)
+	}
+	if firstFrame+numFrames > nframes {
+		numFrames = nframes - firstFrame
+	}
+
+	spf, err := GD_spf_checked(df, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	return c.samples(ctx, df, fieldName, spf, nframes, firstFrame*spf, numFrames*spf, nil)
+}
+
+// getsamples behaves like GD_getdata_samples_ctx but goes through the cache
+func (c *blockCache) getsamples(ctx context.Context, df Dirfile, fieldName string, firstSample, numSamples int, buf []float64) ([]float64, error) {
+	if c == nil || c.budget < 0 {
+		return GD_getdata_samples_ctx(ctx, fieldName, df, firstSample, numSamples, buf)
+	}
+	if numSamples <= 0 || firstSample < 0 {
+		return nil, fmt.Errorf("bad sample range %d+%d: %w", firstSample, numSamples, ErrInvalidRequest)
+	}
+
+	spf, err := GD_spf_checked(df, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	nframes := GD_nframes(df)
+	if firstSample+numSamples > nframes*spf {
+		numSamples = nframes*spf - firstSample
+	}
+	if numSamples <= 0 {
+		return nil, fmt.Errorf("first sample is out of bounds: %w", ErrRange)
+	}
+	return c.samples(ctx, df, fieldName, spf, nframes, firstSample, numSamples, buf)
+}
+
+// samples puts a range of samples together from the blocks covering it, in buf if it is big enough
+// a range bigger than the whole cache would only push everything else out and allocate blocks which
+// get evicted again before the read is done, it goes straight into buf instead
+func (c *blockCache) samples(ctx context.Context, df Dirfile, fieldName string, spf, nframes, firstSample, numSamples int, buf []float64) ([]float64, error) {
+	if numSamples*8 > c.budget {
+		c.mutex.Lock()
+		c.stats.Bypasses++
+		c.mutex.Unlock()
+		return GD_getdata_samples_ctx(ctx, fieldName, df, firstSample, numSamples, buf)
+	}
+	res := buf[:0]
+	if cap(res) < numSamples {
+		res = make([]float64, 0, numSamples)
+	}
+	blockSamples := blockFrames * spf
+	for b := firstSample / blockSamples; b*blockSamples < firstSample+numSamples; b++ {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("reading %s: %w", fieldName, ctx.Err())
+		}
+		blk, err := c.block(df, fieldName, spf, b, nframes)
+		if err != nil {
+			return nil, err
+		}
+		start := firstSample - b*blockSamples
+		if start < 0 {
+			start = 0
+		}
+		end := firstSample + numSamples - b*blockSamples
+		if end > len(blk.data) {
+			end = len(blk.data)
+		}
+		if start < end {
+			res = append(res, blk.data[start:end]...)
+		}
+	}
+	return res, nil
+}
+
+// block returns the up to date block, reading it if it is missing or if the dirfile grew into it
+func (c *blockCache) block(df Dirfile, fieldName string, spf, b, nframes int) (*block, error) {
+	key := blockKey{dirfile: df.name, field: fieldName, block: b}
+	frames := nframes - b*blockFrames
+	if frames > blockFrames {
+		frames = blockFrames
+	}
+
+	c.mutex.Lock()
+	elem, found := c.blocks[key]
+	if found {
+		blk := elem.Value.(*block)
+		if blk.frames == frames {
+			c.lru.MoveToFront(elem)
+			c.stats.Hits++
+			c.mutex.Unlock()
+			return blk, nil
+		}
+		//the tail block is stale, drop it and read it again
+		c.remove(elem)
+		c.stats.Invalidations++
+	}
+	c.stats.Misses++
+	c.mutex.Unlock()
+
+	data := make([]float64, frames*spf)
+	n, err := GD_getdata_c(fieldName, df, b*blockFrames, 0, frames, 0, data)
+	if err != nil {
+		return nil, err
+	}
+	blk := &block{key: key, data: data[:n], frames: frames}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, found := c.blocks[key]; found {
+		//someone else read it while we were not holding the lock
+		c.remove(elem)
+	}
+	c.blocks[key] = c.lru.PushFront(blk)
+	c.size += blk.bytes()
+	for c.size > c.budget && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	return blk, nil
+}
+
+// remove drops an element from the cache, the caller must hold the mutex
+func (c *blockCache) remove(elem *list.Element) {
+	blk := elem.Value.(*block)
+	c.lru.Remove(elem)
+	delete(c.blocks, blk.key)
+	c.size -= blk.bytes()
+}
+
+func (blk *block) bytes() int {
+	return cap(blk.data) * 8
+}
+
+// snapshot returns a copy of the cache statistics
+func (c *blockCache) snapshot() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	stats := c.stats
+	stats.Blocks = c.lru.Len()
+	stats.Bytes = c.size
+	stats.BudgetBytes = c.budget
+	return stats
+}
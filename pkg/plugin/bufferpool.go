@@ -0,0 +1,32 @@
+package plugin
+
+import "sync"
+
+// buffers bigger than this are left to the garbage collector instead of being kept around
+const maxPooledSamples = 1 << 24
+
+// float64 buffers reused between queries. without it every query on a big range allocates
+// the same hundreds of MB over again for the read, the resampled time and the decimation
+var float64Buffers = sync.Pool{
+	New: func() interface{} {
+		return new([]float64)
+	},
+}
+
+// getBuffer gives a slice of length n, the contents are whatever the last user left in it
+func getBuffer(n int) []float64 {
+	buf := float64Buffers.Get().(*[]float64)
+	if cap(*buf) < n {
+		*buf = make([]float64, n)
+	}
+	return (*buf)[:n]
+}
+
+// putBuffer hands a slice from getBuffer back, nothing may use it afterwards
+func putBuffer(buf []float64) {
+	if cap(buf) == 0 || cap(buf) > maxPooledSamples {
+		return
+	}
+	buf = buf[:0]
+	float64Buffers.Put(&buf)
+}
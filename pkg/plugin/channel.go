@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// version of the channel paths made by encodeChan, decodeChan still understands the older "steam" ones
+const streamChannelVersion = "v2"
+
+// streamChannel is what a v2 channel path carries. field names can hold anything (/, __, ...)
+// so the parameters go in as JSON, base64url encoded to stay within what grafana allows in a channel path
+type streamChannel struct {
+	FieldName  string   `json:"f"`
+	FieldNames []string `json:"fs,omitempty"` //more fields in the same frame
+	TimeName   string   `json:"t"`
+	TimeLabel  string   `json:"l,omitempty"` //name of the time field in the frame if not TimeName
+	Interval   string   `json:"i"`
+	TimeType   bool     `json:"tt,omitempty"`
+	SampleRate float64  `json:"sr,omitempty"`
+	TimeOffset float64  `json:"to,omitempty"`
+	TimeFormat string   `json:"tf,omitempty"`
+	Interp     string   `json:"in,omitempty"`
+	Decimation string   `json:"dm,omitempty"`
+	Factor     int      `json:"df,omitempty"` //samples per point, as the query decimated
+	Start      int      `json:"ss,omitempty"` //sample to start at, the end of the query lined up with the buckets
+	Stats      float64  `json:"sw,omitempty"` //rolling statistics over this many seconds instead of samples
+	IndexMode  string   `json:"im,omitempty"` //set along with SampleRate, "field" when the times are the time field as is
+	IndexStart float64  `json:"is,omitempty"`
+}
+
+func encodeChan(UID string, sr StreamRequest) string {
+	c := streamChannel{
+		FieldName:  sr.fieldName,
+		FieldNames: sr.fieldNames,
+		TimeName:   sr.timeName,
+		Interval:   sr.interval.String(),
+		TimeType:   sr.timeType,
+		SampleRate: sr.sampleRate,
+		TimeOffset: sr.timeOffset,
+		TimeFormat: sr.timeFormat,
+		Interp:     sr.interpolation,
+		Decimation: sr.decimationMode,
+		Factor:     sr.factor,
+		Start:      sr.start,
+		Stats:      sr.statsWindow,
+		IndexMode:  sr.indexMode,
+		IndexStart: sr.indexStart,
+	}
+	//channels from before the index modes had a sample rate only for fromEndNow
+	if c.SampleRate != 0 && c.IndexMode == "" {
+		c.IndexMode = "field"
+	}
+	if len(c.FieldNames) == 0 {
+		c.FieldNames = nil
+	}
+	if sr.timeNameField != sr.timeName {
+		c.TimeLabel = sr.timeNameField
+	}
+	payload, _ := json.Marshal(c)
+	return fmt.Sprintf("ds/%s/%s/%s", UID, streamChannelVersion, base64.RawURLEncoding.EncodeToString(payload))
+}
+
+// decodeChan turns the path of a channel (the part after ds/UID/) back into the stream parameters
+// anything which does not decode to a sensible stream is an ErrInvalidRequest
+func decodeChan(path string) (StreamRequest, error) {
+	chunks := strings.Split(path, "/")
+	var sr StreamRequest
+	var err error
+	switch chunks[0] {
+	case streamChannelVersion:
+		sr, err = decodeChanV2(chunks)
+	case "steam":
+		sr, err = decodeChanV1(chunks)
+	default:
+		err = fmt.Errorf("unknown channel version %q", chunks[0])
+	}
+	if err != nil {
+		return StreamRequest{}, fmt.Errorf("bad channel %q: %v: %w", path, err, ErrInvalidRequest)
+	}
+	if err := sr.validate(); err != nil {
+		return StreamRequest{}, fmt.Errorf("bad channel %q: %v: %w", path, err, ErrInvalidRequest)
+	}
+	return sr, nil
+}
+
+func decodeChanV2(chunks []string) (sr StreamRequest, err error) {
+	if len(chunks) != 2 {
+		return sr, fmt.Errorf("expected %s/<parameters>", streamChannelVersion)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(chunks[1])
+	if err != nil {
+		return sr, err
+	}
+	var c streamChannel
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return sr, err
+	}
+	sr.fieldName = c.FieldName
+	if len(c.FieldNames) > 0 {
+		sr.fieldNames = c.FieldNames
+	}
+	sr.timeName = c.TimeName
+	sr.timeNameField = c.TimeLabel
+	if sr.timeNameField == "" {
+		sr.timeNameField = c.TimeName
+	}
+	sr.interval, err = time.ParseDuration(c.Interval)
+	if err != nil {
+		return sr, err
+	}
+	sr.timeType = c.TimeType
+	sr.sampleRate = c.SampleRate
+	sr.timeOffset = c.TimeOffset
+	sr.timeFormat = c.TimeFormat
+	sr.interpolation = c.Interp
+	sr.decimationMode = c.Decimation
+	sr.factor = c.Factor
+	sr.start = c.Start
+	sr.statsWindow = c.Stats
+	sr.indexStart = c.IndexStart
+	switch {
+	case c.IndexMode == "field":
+	case c.IndexMode == "" && c.SampleRate != 0:
+		sr.indexMode = "fromEndNow"
+	default:
+		sr.indexMode = c.IndexMode
+	}
+	return sr, nil
+}
+
+// decodeChanV1 reads the old steam/field/interval/time/bool/rate[/offset[/format]] paths
+// dashboards which were open across an upgrade still subscribe to those
+func decodeChanV1(chunks []string) (sr StreamRequest, err error) {
+	if len(chunks) < 6 || len(chunks) > 8 {
+		return sr, fmt.Errorf("expected 6 to 8 parts, got %d", len(chunks))
+	}
+	sr.fieldName = chunks[1]
+	sr.timeNameField = chunks[3]
+	sr.timeName = strings.Split(sr.timeNameField, "__")[0]
+	sr.interval, err = time.ParseDuration(chunks[2])
+	if err != nil {
+		return
+	}
+	sr.timeType, err = strconv.ParseBool(chunks[4])
+	if err != nil {
+		return
+	}
+	sr.sampleRate, err = strconv.ParseFloat(chunks[5], 64)
+	if err != nil {
+		return
+	}
+	//only fromEndNow streams had a sample rate back then
+	if sr.sampleRate != 0 {
+		sr.indexMode = "fromEndNow"
+	}
+	//channels from before the time offset existed dont have it
+	if len(chunks) > 6 {
+		sr.timeOffset, err = strconv.ParseFloat(chunks[6], 64)
+		if err != nil {
+			return
+		}
+	}
+	if len(chunks) > 7 {
+		sr.timeFormat = chunks[7]
+	}
+	return
+}
+
+// fields gives every field sent on the stream, fieldName first
+func (sr StreamRequest) fields() []string {
+	return append([]string{sr.fieldName}, sr.fieldNames...)
+}
+
+// validate checks the parameters make sense, the channel path comes from the browser so it can be anything
+func (sr StreamRequest) validate() error {
+	if sr.fieldName == "" || sr.timeName == "" {
+		return fmt.Errorf("missing field or time field")
+	}
+	//names end up in JSON and in the frames, both want utf8
+	for _, name := range append([]string{sr.fieldName, sr.timeName, sr.timeNameField}, sr.fieldNames...) {
+		if !utf8.ValidString(name) {
+			return fmt.Errorf("%q is not utf8", name)
+		}
+	}
+	for _, name := range sr.fieldNames {
+		if name == "" {
+			return fmt.Errorf("empty field name")
+		}
+	}
+	if sr.interval < 0 {
+		return fmt.Errorf("negative interval %s", sr.interval)
+	}
+	for _, v := range []float64{sr.sampleRate, sr.timeOffset, sr.statsWindow, sr.indexStart} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%v is not a number", v)
+		}
+	}
+	if sr.factor < 0 {
+		return fmt.Errorf("negative decimation factor %d", sr.factor)
+	}
+	if sr.start < 0 {
+		return fmt.Errorf("negative start sample %d", sr.start)
+	}
+	if sr.sampleRate < 0 {
+		return fmt.Errorf("negative sample rate %v", sr.sampleRate)
+	}
+	if sr.indexMode != "" && (!isIndexOffsetType(sr.indexMode) || sr.sampleRate == 0) {
+		return fmt.Errorf("index mode %q needs a known index offset type and a sample rate", sr.indexMode)
+	}
+	if sr.statsWindow < 0 {
+		return fmt.Errorf("negative statistics window %v", sr.statsWindow)
+	}
+	if err := checkInterpolation(sr.interpolation); err != nil {
+		return err
+	}
+	switch sr.decimationMode {
+	case "", "pick", "mean", "min", "max":
+	default:
+		return fmt.Errorf("unknown decimation mode %s", sr.decimationMode)
+	}
+	return checkTimeFormat(sr.timeFormat)
+}
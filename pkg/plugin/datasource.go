@@ -1,10 +1,10 @@
 package plugin
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
@@ -23,9 +23,18 @@ var (
 )
 
 type Datasource struct {
-	df         Dirfile
-	lastFrame  sync.Map
-	senderLock *sync.Mutex
+	settings     InitSettings
+	readers      *DirfilePool // all the handles on the dirfile, see dirfile() for metadata and streams
+	lastFrame    sync.Map
+	senderLock   *sync.Mutex
+	timeIndexes  sync.Map // time field name -> *timeIndex
+	sampleRates  sync.Map // time field name -> sampleRateEntry
+	pyramids     *pyramidCache
+	blocks       *blockCache
+	streams      *streamRegistry   // RunStream calls in progress, so Dispose can stop them
+	liveness     *liveness         // how the dirfile grows, for the status channel
+	annotations  *annotationWriter // nil unless publishing is turned on
+	streamLimits streamLimits      // shared by all the streams, each stream has its own on top
 }
 
 // NewDatasource creates a new datasource instance.
@@ -36,12 +45,46 @@ func NewDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.In
 	var params InitSettings
 	err := json.Unmarshal(settings.JSONData, &params)
 
+	if err != nil {
+		return nil, err
+	}
+	if params.LeapSecondsFile != "" {
+		if err := loadLeapSeconds(params.LeapSecondsFile); err != nil {
+			backend.Logger.Warn(fmt.Sprintf("Could not load leap seconds, using the built in table: %s", err))
+		}
+	}
+	if params.PublishRole != "" {
+		if _, found := grafanaRoles[params.PublishRole]; !found {
+			backend.Logger.Warn(fmt.Sprintf("Unknown publishRole %s, nobody can publish annotations", params.PublishRole))
+		}
+	}
+	if err := checkTimeFormat(params.DefaultTimeFormat); err != nil {
+		return nil, fmt.Errorf("defaultTimeFormat: %w", err)
+	}
+	if expires := leapSecondsExpire(); time.Now().After(expires) {
+		backend.Logger.Warn(fmt.Sprintf("Leap second table expired on %s, GPS and TAI times may be off by a second. Set leapSecondsFile to a newer leap-seconds.list", expires.Format("2006-01-02")))
+	}
+
+	flags, err := GD_open_flags(params)
 	if err != nil {
 		return nil, err
 	}
 	backend.Logger.Info("Attempting to open database located at: " + fmt.Sprint(params.DatabaseLocation))
-	df := GD_open(params.DatabaseLocation)
-	return &Datasource{df: df, lastFrame: sync.Map{}, senderLock: &sync.Mutex{}}, nil
+	readers := GD_open_pool(params.DatabaseLocation, flags, params.MaxConcurrentQueries)
+	if _, err := readers.primary(); err != nil {
+		//not fatal, the run might just not have started yet. we keep trying whenever someone asks for data
+		backend.Logger.Warn(fmt.Sprintf("Could not open dirfile yet, will retry: %s", err))
+	}
+	return newDatasource(params, readers), nil
+}
+
+func newDatasource(params InitSettings, readers *DirfilePool) *Datasource {
+	d := &Datasource{settings: params, readers: readers, lastFrame: sync.Map{}, senderLock: &sync.Mutex{}, pyramids: newPyramidCache(params.PyramidMemoryMB, readers.primary), blocks: newBlockCache(params.BlockCacheMB), streams: newStreamRegistry(), liveness: newLiveness(), streamLimits: newStreamLimits(params.TotalStreamSamplesPerSecond, params.TotalStreamBytesPerSecond, streamBurst)}
+	if params.AllowPublish && params.AnnotationsLocation != "" {
+		//same open flags as the data dirfile, plus writing
+		d.annotations = newAnnotationWriter(params.AnnotationsLocation, readers.flags)
+	}
+	return d
 }
 
 // Datasource is an example datasource which can respond to data queries, reports
@@ -53,29 +96,19 @@ func NewDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.In
 func (d *Datasource) Dispose() {
 	// Clean up datasource instance resources.
 
-	//close the dirfile, probably a good idea
-	GD_close(d.df)
-}
-
-// CheckHealth handles health checks sent from Grafana to the plugin.
-// The main use case for these health checks is the test button on the
-// datasource configuration page which allows users to verify that
-// a datasource is working as expected.
-func (d *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	//lets try reading the time field as it should always be there
+	//streams and pyramid builds first, they must be done reading before the handles go away
+	d.streams.stop()
+	d.pyramids.stop()
 
-	var status = backend.HealthStatusOk
-	var message = "Data source is working"
-	dummyArray := make([]float64, 1)
-	res := GD_getdata_c("INDEX", d.df, 0, 0, 0, 1, dummyArray)
-	errStr := GD_error(d.df)
-	if errStr != nil || res == 0 {
-		status = backend.HealthStatusError
-		message = fmt.Sprintf("getdata error: %s", errStr.Error())
+	//close the dirfile, probably a good idea
+	//this closes every handle in the pool
+	d.readers.close()
+	if d.annotations != nil {
+		d.annotations.close()
 	}
+}
 
-	return &backend.CheckHealthResult{
-		Status:  status,
-		Message: message,
-	}, nil
+// dirfile gives the primary handle, opening the dirfile if that did not work so far
+func (d *Datasource) dirfile() (Dirfile, error) {
+	return d.readers.primary()
 }
@@ -2,9 +2,18 @@ package plugin
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
 func TestQueryData(t *testing.T) {
@@ -26,3 +35,1504 @@ func TestQueryData(t *testing.T) {
 		t.Fatal("QueryData must return a response")
 	}
 }
+
+func TestQueryDataMultipleQueries(t *testing.T) {
+	ds := Datasource{}
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A"},
+				{RefID: "B"},
+				{RefID: "C"},
+			},
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, refID := range []string{"A", "B", "C"} {
+		if _, found := resp.Responses[refID]; !found {
+			t.Errorf("missing response for query %s", refID)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status backend.Status
+		source errorSource
+	}{
+		{&GetdataError{Code: 3, Message: "Field code not found: FOO", kind: ErrFieldNotFound}, backend.StatusNotFound, errorSourceUser},
+		{fmt.Errorf("first_frame is out of bounds: %w", ErrRange), backend.StatusBadRequest, errorSourceUser},
+		{&GetdataError{Code: 5, Message: "I/O error", kind: ErrIO}, backend.StatusBadGateway, errorSourcePlugin},
+		{errors.New("something else"), backend.StatusInternal, errorSourcePlugin},
+	}
+	for _, c := range cases {
+		status, source := classifyError(c.err)
+		if status != c.status || source != c.source {
+			t.Errorf("%v: expected %v/%v got %v/%v", c.err, c.status, c.source, status, source)
+		}
+	}
+}
+
+func TestMedianFrameRate(t *testing.T) {
+	// 5 frames per second with 2 samples per frame, one dropped sample
+	times := []float64{0, 0.1, 0.2, 0.3, 0.5, 0.6, 0.7}
+	rate, err := medianFrameRate(times, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(rate-5) > 1e-9 {
+		t.Errorf("expected 5 frames per second got %v", rate)
+	}
+
+	if _, err := medianFrameRate([]float64{3, 3, 3}, 1); err == nil {
+		t.Error("expected an error for a time field which does not move")
+	}
+}
+
+func TestUnixSlice2TimeSliceOffset(t *testing.T) {
+	got := unixSlice2TimeSlice([]float64{1000.5}, 86400-0.25)
+	want := time.Unix(1000+86400, 250e6)
+	if !got[0].Equal(want) {
+		t.Errorf("expected %v got %v", want, got[0])
+	}
+}
+
+func TestSampleSpanTrim(t *testing.T) {
+	//time at 1 spf counting seconds, data at 4 spf, ask for frames 2.5 to 4.25
+	span := newSampleSpan(2.5, 4.25, 1, 4, 10)
+	if span.timeFirst != 2 || span.timeNum != 4 || span.dataFirst != 8 || span.dataNum != 16 {
+		t.Fatalf("unexpected span %+v", span)
+	}
+	times := []float64{2, 3, 4, 5}
+	data := make([]float64, 16)
+	for i := range data {
+		data[i] = float64(8 + i)
+	}
+	data, times, skipped := resampleTime(times, span.timeFirst, 1, data, span.dataFirst, 4, "linear", nil)
+	if skipped != 0 || len(data) != 13 {
+		t.Fatalf("unexpected resampling, skipped %d kept %d", skipped, len(data))
+	}
+	first, times, columns := trimColumns(times, [][]float64{data}, 2.5, 4.25)
+	if first != 2 || len(times) != 8 || times[0] != 2.5 || times[7] != 4.25 {
+		t.Errorf("unexpected times %v from %d", times, first)
+	}
+	if len(columns[0]) != 8 || columns[0][0] != 10 {
+		t.Errorf("unexpected data %v", columns[0])
+	}
+	//a range narrower than a sample keeps what is in it and nothing else
+	for _, c := range []struct {
+		from, to float64
+		first    int
+		want     []float64
+	}{{3, 3.1, 2, []float64{3}}, {3.1, 3.2, 3, nil}, {6, 7, 4, nil}} {
+		first, times, columns := trimColumns([]float64{2, 2.5, 3, 3.5}, [][]float64{{0, 1, 2, 3}}, c.from, c.to)
+		if first != c.first || len(times) != len(c.want) || len(columns[0]) != len(c.want) || (len(c.want) == 1 && times[0] != c.want[0]) {
+			t.Errorf("[%v, %v]: expected %v from %d got %v from %d", c.from, c.to, c.want, c.first, times, first)
+		}
+	}
+}
+
+func TestResampleTime(t *testing.T) {
+	//time at 3 spf, data at 5 spf, the time value is just the time sample number
+	times := []float64{0, 1, 2, 3}
+	data := []float64{10, 11, 12, 13, 14}
+	cases := map[string][]float64{
+		"linear":  {0, 0.6, 1.2, 1.8, 2.4},
+		"hold":    {0, 0, 1, 1, 2},
+		"nearest": {0, 1, 1, 2, 2},
+	}
+	for mode, want := range cases {
+		gotData, gotTimes, _ := resampleTime(times, 0, 3, append([]float64(nil), data...), 0, 5, mode, nil)
+		if len(gotTimes) != len(want) || len(gotData) != len(want) {
+			t.Fatalf("%s: expected %d points got %d", mode, len(want), len(gotTimes))
+		}
+		for i := range want {
+			if math.Abs(gotTimes[i]-want[i]) > 1e-9 {
+				t.Errorf("%s: point %d expected %v got %v", mode, i, want[i], gotTimes[i])
+			}
+		}
+	}
+
+	//no making up times past the last time sample
+	gotData, _, _ := resampleTime(times[:2], 0, 3, data, 0, 5, "linear", nil)
+	if len(gotData) != 2 {
+		t.Errorf("expected 2 points got %v", gotData)
+	}
+}
+
+func TestResampleValues(t *testing.T) {
+	//data at 2 spf read at the samples of a 4 spf time field, the data value is the data sample number
+	data := []float64{0, 1, 2, 3}
+	got := resampleValues(data, 0, 2, 0, 4, 8, "linear")
+	want := []float64{0, 0.5, 1, 1.5, 2, 2.5, 3}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("point %d expected %v got %v", i, want[i], got[i])
+		}
+	}
+	//nothing to interpolate to past the last data sample
+	if !math.IsNaN(got[7]) {
+		t.Errorf("expected NaN got %v", got[7])
+	}
+
+	fields := QueryModel{FieldName: "a", FieldNames: []string{"b", "a", "", "c"}}.fields()
+	if !reflect.DeepEqual(fields, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestSummariseValues(t *testing.T) {
+	//data at 4 spf summarised per sample of a 1 spf time field, a spike in between time samples is kept
+	data := []float64{0, 1, 9, 3, 4, 5, 6, 7}
+	if got := summariseValues(data, 0, 4, 0, 1, 3, "max"); got[0] != 9 || got[1] != 7 || !math.IsNaN(got[2]) {
+		t.Errorf("unexpected max %v", got)
+	}
+	if got := summariseValues(data, 0, 4, 0, 1, 2, "mean"); got[0] != 13.0/4 || got[1] != 5.5 {
+		t.Errorf("unexpected mean %v", got)
+	}
+	if summarisesValues(4, 1, "pick") || summarisesValues(1, 4, "max") || !summarisesValues(4, 1, "min") {
+		t.Error("wrong choice between summarising and resampling")
+	}
+
+	//a wide read gives every field the summary of the samples behind each time sample
+	path := testDirfile(t, 20, map[string]int{"a": 100, "b": 1})
+	df, err := GD_open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+	times, columns, err := getdata_wide(context.Background(), df, newBlockCache(0), "TIME", []string{"a", "b"}, 0, 20, "linear", "max")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 20 || columns[0][3] != 399 || columns[1][3] != 3 {
+		t.Errorf("unexpected wide read %v %v", times, columns)
+	}
+}
+
+func TestResumePosition(t *testing.T) {
+	ds := Datasource{}
+	lastFrame := 41
+	first, _, err := ds.resumePosition(context.Background(), Dirfile{}, StreamRequest{}, StreamResume{LastFrame: &lastFrame}, 100)
+	if err != nil || first != 42 {
+		t.Errorf("expected frame 42 got %d (%v)", first, err)
+	}
+
+	//an index stream at 10 frames a second whose last point was 2 seconds ago
+	lastTime := float64(time.Now().Add(-2 * time.Second).UnixMilli())
+	first, _, err = ds.resumePosition(context.Background(), Dirfile{}, StreamRequest{sampleRate: 10, indexMode: "fromEndNow"}, StreamResume{LastTime: &lastTime}, 100)
+	if err != nil || first < 79 || first > 81 {
+		t.Errorf("expected frame 80 or so got %d (%v)", first, err)
+	}
+
+	//an index stream whose frame 0 was at 1000s, the last point at 1004.5s was frame 45
+	lastTime = 1004500
+	first, _, err = ds.resumePosition(context.Background(), Dirfile{}, StreamRequest{sampleRate: 10, indexMode: "fromStart", indexStart: 1000}, StreamResume{LastTime: &lastTime}, 100)
+	if err != nil || first != 46 {
+		t.Errorf("expected frame 46 got %d (%v)", first, err)
+	}
+}
+
+func TestBackfillMeetsLive(t *testing.T) {
+	path := testDirfile(t, 51, map[string]int{"a": 10})
+	df, err := GD_open(path, GD_open_rw_flags(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+	ds := &Datasource{blocks: newBlockCache(0)}
+	//10 samples a second, a point every 2 seconds is buckets of 20 samples
+	sr := StreamRequest{fieldName: "a", timeName: "TIME", timeNameField: "TIME", interval: 2 * time.Second, timeType: true, sampleRate: 1, decimationMode: "mean"}
+
+	initial, resumeFrame, err := ds.backfill(context.Background(), df, sr, json.RawMessage(`{"lastFrame":9}`))
+	if err != nil || initial == nil {
+		t.Fatalf("no backfill: %v", err)
+	}
+	//samples 100 to 499 are whole buckets, the one from 500 is left to the live updates
+	if resumeFrame != 50 {
+		t.Errorf("expected the live updates to carry on from frame 50, got %d", resumeFrame)
+	}
+	var frame data.Frame
+	if err := json.Unmarshal(initial.Data(), &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Rows() != 20 || frame.Fields[1].At(0).(float64) != 109.5 {
+		t.Errorf("unexpected backfill of %d points", frame.Rows())
+	}
+
+	//the live updates go on with buckets of the same size and alignment
+	for _, name := range []string{"TIME", "a"} {
+		spf := GD_spf(df, name)
+		values := make([]float64, 3*spf)
+		for i := range values {
+			values[i] = float64(51*spf + i)
+			if name == "TIME" {
+				values[i] += 1000
+			}
+		}
+		if _, err := GD_putdata(df, name, 51*spf, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	times, columns, _, err := ds.streamTick(context.Background(), df, sr, &streamDecimator{}, resumeFrame, GD_nframes(df), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 1 || columns[0][0] != 509.5 {
+		t.Errorf("expected the bucket from sample 500, got %v", columns)
+	}
+}
+
+func TestStreamStartsWhereQueryStopped(t *testing.T) {
+	path := testDirfile(t, 100, map[string]int{"a": 10})
+	ds := newDatasource(InitSettings{PyramidMemoryMB: -1}, GD_open_pool(path, 0, 1))
+	defer ds.Dispose()
+	res := ds.query(context.Background(), backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "uid"}}, backend.DataQuery{
+		JSON:          []byte(`{"fieldName":"a","timeName":"TIME","timeType":true,"streamingBool":true,"decimationMode":"mean"}`),
+		TimeRange:     backend.TimeRange{From: time.Unix(1000, 0), To: time.Unix(1049, 0)},
+		MaxDataPoints: 30,
+	}, "")
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	frame := res.Frames[0]
+	channel := strings.TrimPrefix(frame.Meta.Channel, "ds/uid/")
+	sr, err := decodeChan(channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the query read up to sample 490, the bucket it is in starts at 480
+	if sr.factor != 20 || sr.start != 480 {
+		t.Fatalf("expected the stream to start at 480 with buckets of 20, got %d and %d", sr.start, sr.factor)
+	}
+
+	if _, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: channel}); err != nil {
+		t.Fatal(err)
+	}
+	lastFrame, _ := ds.lastFrame.Load(channel)
+	if lastFrame != 48 {
+		t.Fatalf("expected the stream to read from frame 48, got %v", lastFrame)
+	}
+	df, err := ds.dirfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, columns, _, err := ds.streamTick(context.Background(), df, sr, &streamDecimator{}, 48, GD_nframes(df), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the partial last point of the query comes again complete, and nothing before it
+	last := frame.Rows() - 1
+	if queryTime := frame.Fields[0].At(last).(time.Time); len(times) == 0 || times[0] != float64(queryTime.Unix()) {
+		t.Fatalf("stream starts at %v, the last point of the query is at %v", times, queryTime)
+	}
+	if frame.Fields[1].At(last).(float64) != 485 || columns[0][0] != 489.5 {
+		t.Errorf("expected the bucket from 480 partial in the query and complete in the stream, got %v and %v", frame.Fields[1].At(last), columns[0][0])
+	}
+
+	//a subscriber joining a running stream does not move it
+	_, done, err := ds.streams.start(context.Background(), channel, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	ds.lastFrame.Store(channel, 70)
+	if _, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: channel}); err != nil {
+		t.Fatal(err)
+	}
+	if lastFrame, _ := ds.lastFrame.Load(channel); lastFrame != 70 {
+		t.Errorf("running stream was moved to frame %v", lastFrame)
+	}
+}
+
+func TestIndexTimes(t *testing.T) {
+	//fromEnd counts back from the frames there were when the query ran
+	start := indexStart("fromEnd", 2000, 10, 500)
+	if start != 1950 {
+		t.Fatalf("expected frame 0 at 1950 got %v", start)
+	}
+	for _, c := range []struct {
+		mode  string
+		start float64
+		want  []int64
+	}{
+		{"fromStart", 1000, []int64{1000000, 1000100, 1050000}},
+		{"fromEnd", start, []int64{1950000, 1950100, 2000000}},
+		{"fromEndNow", 0, []int64{2950000, 2950100, 3000000}},
+	} {
+		times := indexTimes(c.mode, []float64{0, 1, 500}, 10, c.start, time.Unix(3000, 0))
+		for i, want := range c.want {
+			//the conversion truncates to the nanosecond, a tenth of a second can come out a hair short
+			if got := times[i].UnixMilli(); got < want-1 || got > want {
+				t.Errorf("%s: point %d expected %d got %d", c.mode, i, want, got)
+			}
+		}
+	}
+}
+
+func TestDecimatorAcrossTicks(t *testing.T) {
+	//a series of 103 samples starting at sample 5, decimated down to 30 points in one go like a query does
+	const first, maxPoints = 5, 30
+	times := make([]float64, 103)
+	values := make([]float64, 103)
+	for i := range times {
+		times[i] = float64(first + i)
+		values[i] = math.Sin(float64(i)) * float64(i)
+	}
+	factor := decimationFactor(first, len(times), maxPoints)
+	if factor != 4 {
+		t.Fatalf("expected a factor of 4 got %d", factor)
+	}
+	for _, mode := range []string{"pick", "mean", "min", "max"} {
+		wantBuf := append([]float64{}, values...)
+		wantTimes, wantColumns := decimateFrom(first, append([]float64{}, times...), [][]float64{wantBuf}, maxPoints, mode)
+		//a query decimates in the buffer it read into
+		if &wantColumns[0][0] != &wantBuf[0] {
+			t.Errorf("%s: decimated into new memory", mode)
+		}
+
+		//the same series coming in as ticks of odd sizes, with some samples read twice, decimated
+		//by the factor the query hands on to the stream
+		ticks := newDecimator(factor, mode)
+		var gotTimes, gotValues []float64
+		for start := 0; start < len(times); start += 7 {
+			from := start - 2
+			if from < 0 {
+				from = 0
+			}
+			end := start + 7
+			if end > len(times) {
+				end = len(times)
+			}
+			tickTimes, tickColumns := ticks.feed(first+from, times[from:end], [][]float64{values[from:end]})
+			gotTimes = append(gotTimes, tickTimes...)
+			gotValues = append(gotValues, tickColumns[0]...)
+		}
+		if lastTime, lastColumns := ticks.flush(); len(lastTime) > 0 {
+			gotTimes = append(gotTimes, lastTime...)
+			gotValues = append(gotValues, lastColumns[0]...)
+		}
+		if !reflect.DeepEqual(gotTimes, wantTimes) || !reflect.DeepEqual(gotValues, wantColumns[0]) {
+			t.Errorf("%s: ticks gave %v %v, the query %v %v", mode, gotTimes, gotValues, wantTimes, wantColumns[0])
+		}
+		//buckets start on multiples of the factor
+		if wantTimes[0] != 5 || wantTimes[1] != 8 {
+			t.Errorf("%s: buckets not lined up %v", mode, wantTimes[:2])
+		}
+	}
+
+	//the factor handed on to a stream fits the frames, a divisor or a multiple of the samples per frame
+	if got := streamDecimationFactor(0, 1000, 300, 10); got != 5 {
+		t.Errorf("expected 5 got %d", got)
+	}
+	if got := streamDecimationFactor(0, 1000, 60, 10); got != 20 {
+		t.Errorf("expected 20 got %d", got)
+	}
+	if got := streamDecimationFactor(0, 100, 1000, 10); got != 1 {
+		t.Errorf("expected no decimation got %d", got)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	l := newLiveness()
+	start := time.Unix(1000, 0)
+	l.observe(100, start)
+	rate, since := l.observe(150, start.Add(5*time.Second))
+	if rate != 10 || since != 0 {
+		t.Errorf("expected 10 frames/s just now, got %v %v", rate, since)
+	}
+	//acquisition stopped
+	rate, since = l.observe(150, start.Add(60*time.Second))
+	if rate != 0 || since != 55*time.Second {
+		t.Errorf("expected a stopped dirfile, got %v %v", rate, since)
+	}
+}
+
+func TestRollingStats(t *testing.T) {
+	s := newRollingStats(5)
+	for _, v := range s.values() {
+		if !math.IsNaN(v) {
+			t.Fatalf("expected NaN for an empty window, got %v", s.values())
+		}
+	}
+
+	//unix times a tenth of a second apart, and a wiggle on a slope
+	var xs, vs []float64
+	for i := 0; i < 2000; i++ {
+		x := 1.6e9 + float64(i)*0.1
+		v := 10*math.Sin(float64(i)*0.7) + 0.5*float64(i)
+		s.add(x, v)
+		s.add(x, math.NaN()) //no data, ignored
+		xs, vs = append(xs, x), append(vs, v)
+
+		//the same over the window from scratch
+		var n, sum, sumSq, sumX, sumXX, sumXV float64
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for j := range xs {
+			if xs[j] < x-5 {
+				continue
+			}
+			dx := xs[j] - x
+			n++
+			sum += vs[j]
+			sumSq += vs[j] * vs[j]
+			sumX += dx
+			sumXX += dx * dx
+			sumXV += dx * vs[j]
+			lo, hi = math.Min(lo, vs[j]), math.Max(hi, vs[j])
+		}
+		want := []float64{sum / n, math.Sqrt(sumSq / n), lo, hi, math.NaN()}
+		if n > 1 {
+			want[4] = (n*sumXV - sumX*sum) / (n*sumXX - sumX*sumX)
+		}
+		got := s.values()
+		for k := range want {
+			if math.IsNaN(want[k]) != math.IsNaN(got[k]) || math.Abs(got[k]-want[k]) > 1e-6*math.Max(1, math.Abs(want[k])) {
+				t.Fatalf("sample %d %s: expected %v got %v", i, streamStatistics[k], want[k], got[k])
+			}
+		}
+	}
+	//the window holds 5s worth, not everything that came in
+	if n := len(s.samples) - s.head; n != 51 {
+		t.Errorf("expected 51 samples in the window, got %d", n)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	ds := newDatasource(InitSettings{TotalStreamBytesPerSecond: 1600}, GD_open_pool("/nonexistent", 0, 1))
+	now := time.Unix(1000, 0)
+	times := make([]float64, 1000)
+	column := make([]float64, 1000)
+	for i := range times {
+		times[i], column[i] = float64(i), float64(i)
+	}
+
+	//100 values per second for 5s is 500 points of one column
+	limits := newStreamLimits(100, 0, streamBurst)
+	got, columns, notice := ds.limitStream(limits, StreamRequest{}, times, [][]float64{column}, now)
+	if len(got) > 500 || len(got) < 400 || len(columns[0]) != len(got) || notice == "" {
+		t.Errorf("expected about 500 points and a notice, got %d %q", len(got), notice)
+	}
+	//the burst is used up, a second later there is room for a second worth
+	got, _, _ = ds.limitStream(limits, StreamRequest{}, times, [][]float64{column}, now.Add(time.Second))
+	if len(got) > 100 {
+		t.Errorf("expected at most 100 points, got %d", len(got))
+	}
+	//everything is used up, a point still goes out
+	got, _, notice = ds.limitStream(limits, StreamRequest{}, times, [][]float64{column}, now.Add(time.Second))
+	if len(got) != 1 || notice == "" {
+		t.Errorf("expected a single point, got %d %q", len(got), notice)
+	}
+
+	//the datasource limit applies on top: 1600 bytes/s of 16 byte points is 500 points in 5s
+	//and the first stream already used all of them
+	got, _, notice = ds.limitStream(newStreamLimits(0, 0, streamBurst), StreamRequest{}, times[:10], [][]float64{column[:10]}, now.Add(time.Second))
+	if len(got) > 1 || notice == "" {
+		t.Errorf("expected the datasource limit to kick in, got %d %q", len(got), notice)
+	}
+
+	//no limits, nothing happens
+	free := newDatasource(InitSettings{}, GD_open_pool("/nonexistent", 0, 1))
+	got, _, notice = free.limitStream(newStreamLimits(0, 0, streamBurst), StreamRequest{}, times, [][]float64{column}, now)
+	if len(got) != len(times) || notice != "" {
+		t.Errorf("expected every point without a notice, got %d %q", len(got), notice)
+	}
+}
+
+func TestTimeFormatRoundTrip(t *testing.T) {
+	unix := 1600000000.5
+	for format := range timeFormats {
+		got := toUnix(fromUnix(unix, format), format)
+		if math.Abs(got-unix) > 1e-3 {
+			t.Errorf("%s: expected %v got %v", format, unix, got)
+		}
+	}
+
+	// 2020-09-13T12:26:40Z was 1284035218 in GPS seconds (18 leap seconds since 1980)
+	if gps := fromUnix(1600000000, "gps"); gps != 1284035218 {
+		t.Errorf("expected gps 1284035218 got %v", gps)
+	}
+	if mjd := fromUnix(0, "mjd"); mjd != 40587 {
+		t.Errorf("expected mjd 40587 got %v", mjd)
+	}
+}
+
+func TestLeapSecondBoundary(t *testing.T) {
+	// the leap second at the end of 2016 took TAI-UTC from 36 to 37
+	lastSecond2016 := float64(time.Date(2016, 12, 31, 23, 59, 59, 0, time.UTC).Unix())
+	firstSecond2017 := lastSecond2016 + 1
+
+	if offset := taiMinusUTC(lastSecond2016); offset != 36 {
+		t.Errorf("expected TAI-UTC 36 at the end of 2016 got %v", offset)
+	}
+	if offset := taiMinusUTC(firstSecond2017); offset != 37 {
+		t.Errorf("expected TAI-UTC 37 at the start of 2017 got %v", offset)
+	}
+
+	// one unix second apart but two GPS seconds apart because of 23:59:60
+	gpsBefore := fromUnix(lastSecond2016, "gps")
+	gpsAfter := fromUnix(firstSecond2017, "gps")
+	if gpsAfter-gpsBefore != 2 {
+		t.Errorf("expected 2 GPS seconds across the leap second got %v", gpsAfter-gpsBefore)
+	}
+	if gpsBefore != 1167264016 {
+		t.Errorf("expected gps 1167264016 at the end of 2016 got %v", gpsBefore)
+	}
+
+	// every GPS second around the boundary has to come back to the unix second it started from,
+	// the leap second itself has no unix time and shows as the first second of 2017
+	for _, c := range []struct{ gps, unix float64 }{
+		{gpsBefore - 1, lastSecond2016 - 1},
+		{gpsBefore, lastSecond2016},
+		{gpsBefore + 1, firstSecond2017},
+		{gpsAfter, firstSecond2017},
+		{gpsAfter + 1, firstSecond2017 + 1},
+	} {
+		if got := toUnix(c.gps, "gps"); got != c.unix {
+			t.Errorf("gps %v: expected unix %v got %v", c.gps, c.unix, got)
+		}
+	}
+
+	// same thing in TAI
+	for _, unix := range []float64{lastSecond2016 - 0.5, lastSecond2016, firstSecond2017, firstSecond2017 + 0.5} {
+		if got := toUnix(fromUnix(unix, "tai"), "tai"); got != unix {
+			t.Errorf("tai round trip of %v gave %v", unix, got)
+		}
+	}
+}
+
+func TestParseLeapSeconds(t *testing.T) {
+	list := "#@\t3991593600\n2272060800\t10\t# 1 Jan 1972\n3692217600\t37\t# 1 Jan 2017\n"
+	table, err := parseLeapSeconds("test", strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.entries) != 2 || table.entries[1].unix != 1483228800 || table.entries[1].taiMinusUTC != 37 {
+		t.Errorf("unexpected entries %+v", table.entries)
+	}
+	if !table.expires.Equal(time.Date(2026, 6, 28, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected expiry %v", table.expires)
+	}
+
+	if _, err := parseLeapSeconds("test", strings.NewReader("# nothing in here\n")); err == nil {
+		t.Error("expected an error for an empty table")
+	}
+
+	//the shipped table is the upstream file and passes its own hash, a damaged copy does not
+	if !mustParseLeapSeconds(embeddedLeapSeconds).verified {
+		t.Error("embedded table does not match its hash")
+	}
+	damaged := strings.Replace(string(embeddedLeapSeconds), "3692217600      37", "3692217600      36", 1)
+	if damaged == string(embeddedLeapSeconds) {
+		t.Fatal("did not find the 2017 leap second to damage")
+	}
+	table, err = parseLeapSeconds("test", strings.NewReader(damaged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.verified || table.entries[len(table.entries)-1].taiMinusUTC != 36 {
+		t.Errorf("expected the damaged table to be used but not verified, got %+v", table)
+	}
+}
+
+// benchmarkQuery runs a whole query: the time lookup, reading through the block cache, resampling,
+// trimming, decimating and building the frame. 1 hour of a 100Hz field against a 1Hz time field, sent as 1000 points
+func benchmarkQuery(b *testing.B, blockCacheMB int) {
+	path := testDirfile(b, 3600, map[string]int{"data": 100})
+	ds := newDatasource(InitSettings{PyramidMemoryMB: -1, BlockCacheMB: blockCacheMB}, GD_open_pool(path, 0, 1))
+	defer ds.Dispose()
+	query := backend.DataQuery{
+		JSON:          []byte(`{"fieldName":"data","timeName":"TIME","timeType":true,"decimationMode":"mean"}`),
+		TimeRange:     backend.TimeRange{From: time.Unix(1000, 0), To: time.Unix(4599, 0)},
+		MaxDataPoints: 1000,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		resp := ds.query(context.Background(), backend.PluginContext{}, query, "")
+		if resp.Error != nil {
+			b.Fatal(resp.Error)
+		}
+		if resp.Frames[0].Rows() == 0 {
+			b.Fatal("no points")
+		}
+	}
+}
+
+func BenchmarkQueryUncached(b *testing.B) {
+	benchmarkQuery(b, -1)
+}
+
+// the blocks get read on the first run, after that the query is served from the cache
+func BenchmarkQueryCached(b *testing.B) {
+	benchmarkQuery(b, 0)
+}
+
+// the range is bigger than the cache so it is read straight into the query buffers
+func BenchmarkQueryBiggerThanCache(b *testing.B) {
+	benchmarkQuery(b, 1)
+}
+
+func TestChannelRoundTrip(t *testing.T) {
+	sr := StreamRequest{
+		fieldName:     "odd/name__with.stuff",
+		fieldNames:    []string{"second", "third/one"},
+		interpolation: "hold",
+		timeNameField: "TIME__1",
+		timeName:      "TIME",
+		interval:      1500 * time.Millisecond,
+		timeType:      true,
+		sampleRate:    0.125,
+		timeOffset:    -3.5,
+		timeFormat:    "gps",
+		statsWindow:   60,
+		factor:        40,
+	}
+	channel := encodeChan("uid", sr)
+	path := strings.TrimPrefix(channel, "ds/uid/")
+	got, err := decodeChan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sr) {
+		t.Errorf("expected %+v got %+v", sr, got)
+	}
+
+	//index streams carry their offset type and start
+	index := StreamRequest{fieldName: "a", timeName: "INDEX", timeNameField: "INDEX", interval: time.Second, timeType: true, sampleRate: 10, indexMode: "fromEnd", indexStart: 1950}
+	got, err = decodeChan(strings.TrimPrefix(encodeChan("uid", index), "ds/uid/"))
+	if err != nil || !reflect.DeepEqual(got, index) {
+		t.Errorf("expected %+v got %+v (%v)", index, got, err)
+	}
+
+	//old style paths still work, broken ones of any style do not
+	if _, err := decodeChan("steam/field/1s/TIME__0/true/0.000/0/unix"); err != nil {
+		t.Error(err)
+	}
+	//a sample rate used to mean fromEndNow
+	for _, old := range []string{"steam/field/1s/INDEX/true/10", "v2/" + base64.RawURLEncoding.EncodeToString([]byte(`{"f":"a","t":"INDEX","i":"1s","tt":true,"sr":10}`))} {
+		if sr, err := decodeChan(old); err != nil || sr.indexMode != "fromEndNow" {
+			t.Errorf("%s: expected a fromEndNow stream got %+v (%v)", old, sr, err)
+		}
+	}
+	for _, bad := range []string{"", "steam", "steam/a/b", "v2", "v2/!!", "v2/e30", "v9/x", path + "/extra"} {
+		if _, err := decodeChan(bad); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("%q: expected an invalid request, got %v", bad, err)
+		}
+	}
+}
+
+func FuzzDecodeChan(f *testing.F) {
+	f.Add(strings.TrimPrefix(encodeChan("uid", StreamRequest{fieldName: "a/b", timeName: "TIME", timeNameField: "TIME", interval: time.Second}), "ds/uid/"))
+	f.Add("steam/field/1s/TIME__0/true/0.000/0/unix")
+	f.Add("steam/field/1s/TIME/false/0")
+	f.Add("v2/")
+	f.Fuzz(func(t *testing.T, path string) {
+		sr, err := decodeChan(path)
+		if err != nil {
+			return
+		}
+		//anything accepted has to survive a round trip
+		again, err := decodeChan(strings.TrimPrefix(encodeChan("uid", sr), "ds/uid/"))
+		if err != nil {
+			t.Fatalf("%q decoded to %+v which does not round trip: %v", path, sr, err)
+		}
+		if !reflect.DeepEqual(again, sr) {
+			t.Fatalf("%q decoded to %+v then %+v", path, sr, again)
+		}
+	})
+}
+
+func TestStreamLifecycle(t *testing.T) {
+	//the dirfile does not exist, the stream just waits for it
+	ds := newDatasource(InitSettings{}, GD_open_pool("/nonexistent", 0, 1))
+	path := strings.TrimPrefix(encodeChan("uid", StreamRequest{fieldName: "a", timeName: "TIME", timeNameField: "TIME", interval: time.Second}), "ds/uid/")
+	ds.lastFrame.Store(path, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan error)
+	go func() {
+		finished <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, nil)
+	}()
+	waitFor(t, func() bool { return ds.streams.active(path) })
+
+	//grafana stopping the stream forgets the channel
+	cancel()
+	<-finished
+	if ds.streams.count() != 0 {
+		t.Errorf("stream still registered")
+	}
+	if _, found := ds.lastFrame.Load(path); found {
+		t.Errorf("last frame of the channel was kept")
+	}
+
+	//dispose stops the streams still running, and does not let new ones start
+	go func() {
+		finished <- ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: path}, nil)
+	}()
+	waitFor(t, func() bool { return ds.streams.active(path) })
+	ds.Dispose()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispose did not stop the stream")
+	}
+	if err := ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: path}, nil); err == nil {
+		t.Error("stream started on a disposed datasource")
+	}
+	if _, err := ds.dirfile(); err == nil {
+		t.Error("dirfile opened on a disposed datasource")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for start := time.Now(); !condition(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestPublishStream(t *testing.T) {
+	settings := InitSettings{AnnotationsLocation: "/nonexistent/annotations", AllowPublish: true}
+	publish := func(settings InitSettings, path string, user *backend.User, payload string) (*backend.PublishStreamResponse, error) {
+		ds := newDatasource(settings, GD_open_pool("/nonexistent", 0, 1))
+		defer ds.Dispose()
+		return ds.PublishStream(context.Background(), &backend.PublishStreamRequest{
+			PluginContext: backend.PluginContext{User: user},
+			Path:          path,
+			Data:          []byte(payload),
+		})
+	}
+	viewer := &backend.User{Login: "v", Role: "Viewer"}
+	editor := &backend.User{Login: "e", Role: "Editor"}
+	admin := &backend.User{Login: "a", Role: "Admin"}
+	valid := `{"field":"flag","value":1}`
+
+	statuses := []struct {
+		name     string
+		settings InitSettings
+		path     string
+		user     *backend.User
+		want     backend.PublishStreamStatus
+	}{
+		{"other channel", settings, "status", editor, backend.PublishStreamStatusNotFound},
+		{"publishing off", InitSettings{AnnotationsLocation: "/nonexistent/annotations"}, annotationsChannelPath, admin, backend.PublishStreamStatusPermissionDenied},
+		{"no location", InitSettings{AllowPublish: true}, annotationsChannelPath, admin, backend.PublishStreamStatusPermissionDenied},
+		{"no user", settings, annotationsChannelPath, nil, backend.PublishStreamStatusPermissionDenied},
+		{"viewer", settings, annotationsChannelPath, viewer, backend.PublishStreamStatusPermissionDenied},
+		{"editor below admin", InitSettings{AnnotationsLocation: "/nonexistent/annotations", AllowPublish: true, PublishRole: "Admin"}, annotationsChannelPath, editor, backend.PublishStreamStatusPermissionDenied},
+		{"unknown role", InitSettings{AnnotationsLocation: "/nonexistent/annotations", AllowPublish: true, PublishRole: "Operator"}, annotationsChannelPath, admin, backend.PublishStreamStatusPermissionDenied},
+	}
+	for _, c := range statuses {
+		resp, err := publish(c.settings, c.path, c.user, valid)
+		if err != nil || resp.Status != c.want {
+			t.Errorf("%s: got %v %v, want status %v", c.name, resp, err, c.want)
+		}
+	}
+
+	//allowed users get bad payloads refused before anything is written
+	for _, payload := range []string{
+		`not json`,
+		`{"field":"flag"}`,
+		`{"field":"flag","value":1,"text":"both"}`,
+		`{"field":"../flag","value":1}`,
+		`{"field":"1flag","value":1}`,
+		`{"field":"flag","text":"` + strings.Repeat("x", maxAnnotationText+1) + `"}`,
+	} {
+		if _, err := publish(settings, annotationsChannelPath, editor, payload); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("%s: got %v, want an invalid request", payload, err)
+		}
+	}
+	//a good payload gets as far as opening the annotations dirfile, which is not there
+	if _, err := publish(settings, annotationsChannelPath, editor, `{"field":"comment","text":"beam off for maintenance"}`); err == nil || errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("got %v, want a getdata error", err)
+	}
+}
+
+func TestPyramidCache(t *testing.T) {
+	path := testDirfile(t, 4096, map[string]int{"a": 256, "b": 256})
+	df, err := GD_open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+	open := func() (Dirfile, error) { return df, nil }
+	//the first zoomed out read of a field leaves its pyramid building in the background, the next one is served from it
+	built := func(c *pyramidCache, timeName, fieldName string) ([]float64, []float64, int, bool, error) {
+		if _, _, _, ok, err := c.read(context.Background(), df, timeName, fieldName, "mean", 0, 4096, 16); err != nil || ok {
+			t.Errorf("expected the first read of %s to be left to raw data, got %v %v", fieldName, ok, err)
+		}
+		c.running.Wait()
+		return c.read(context.Background(), df, timeName, fieldName, "mean", 0, 4096, 16)
+	}
+	c := newPyramidCache(0, open)
+	defer c.stop()
+
+	values, times, factor, ok, err := built(c, "TIME", "a")
+	if err != nil || !ok {
+		t.Fatalf("pyramid did not serve the read: %v", err)
+	}
+	if len(values) != 16 || values[1] != 65536+32767.5 || times[1] != 1256 || factor != 65536 {
+		t.Errorf("got %v at %v by %d", values, times, factor)
+	}
+
+	//zoomed in reads never touch the pyramids
+	if _, _, _, ok, _ := c.read(context.Background(), df, "TIME", "a", "mean", 0, 64, 16); ok {
+		t.Error("pyramid served a read finer than it stores")
+	}
+
+	//a query catching up on a few buckets only holds up the queries on the same field
+	held := c.pyramids["a"]
+	if err := held.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, _, _, err := c.read(ctx, df, "TIME", "a", "mean", 0, 4096, 16); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected to give up waiting, got %v", err)
+	}
+	if _, _, _, ok, err := built(c, "INDEX", "b"); err != nil || !ok {
+		t.Errorf("read of another field was held up: %v", err)
+	}
+
+	//but nobody waits for a build in the background, they read raw data meanwhile
+	c.mutex.Lock()
+	held.building = true
+	c.mutex.Unlock()
+	start := time.Now()
+	if _, _, _, ok, err := c.read(context.Background(), df, "TIME", "a", "mean", 0, 4096, 16); err != nil || ok {
+		t.Errorf("expected the read to be left to raw data, got %v %v", ok, err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Errorf("read waited %v for the build", time.Since(start))
+	}
+	c.mutex.Lock()
+	held.building = false
+	c.mutex.Unlock()
+	held.release()
+
+	//both pyramids of the query stay, the least recently used other one goes
+	c = newPyramidCache(0, open)
+	defer c.stop()
+	c.budget = pyramidBytes(4096, 0) + pyramidBytes(4096, baseLevel(1))
+	for _, field := range []string{"a", "b"} {
+		if _, _, _, ok, err := built(c, "TIME", field); err != nil || !ok {
+			t.Fatalf("pyramid did not serve %s: %v", field, err)
+		}
+	}
+	if c.pyramids["TIME"] == nil || c.pyramids["b"] == nil || c.pyramids["a"] != nil {
+		t.Errorf("expected TIME and b to be kept, got %v", reflect.ValueOf(c.pyramids).MapKeys())
+	}
+
+	//a pair which does not fit at full resolution starts coarser
+	c = newPyramidCache(0, open)
+	defer c.stop()
+	c.budget = pyramidBytes(4096, 3) + pyramidBytes(4096, baseLevel(1))
+	if _, _, _, ok, err := c.read(context.Background(), df, "TIME", "a", "mean", 0, 4096, 16); err != nil || !ok {
+		t.Fatalf("pyramid did not serve the read: %v", err)
+	}
+	if p := c.pyramids["a"]; p == nil || p.baseLevel != 3 {
+		t.Error("expected a to start at level 3")
+	}
+
+	//once stopped no more builds start, the query still gets its pyramid locks back
+	c = newPyramidCache(0, open)
+	c.stop()
+	if _, _, _, ok, err := c.read(context.Background(), df, "TIME", "a", "mean", 0, 4096, 16); err != nil || ok {
+		t.Errorf("expected the read to be left to raw data, got %v %v", ok, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if p := c.pyramids["a"]; p == nil || p.building || p.acquire(ctx) != nil {
+		t.Error("expected a to be left idle and unlocked")
+	}
+}
+
+// testDirfile writes a dirfile with nframes frames: TIME holds unix seconds from 1000 at one frame a second
+// and every other field holds its sample number, with the given samples per frame
+func testDirfile(t testing.TB, nframes int, fields map[string]int) string {
+	t.Helper()
+	path := t.TempDir() + "/dirfile"
+	writeTestDirfile(t, path, nframes, fields)
+	return path
+}
+
+// writeTestDirfile is testDirfile at a given path
+func writeTestDirfile(t testing.TB, path string, nframes int, fields map[string]int) {
+	t.Helper()
+	df, err := GD_open(path, GD_open_rw_flags(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+	columns := map[string]int{"TIME": 1}
+	for name, spf := range fields {
+		columns[name] = spf
+	}
+	//TIME first, getdata counts frames with the first RAW field
+	names := []string{"TIME"}
+	for name := range fields {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		spf := columns[name]
+		if err := GD_add_raw(df, name, spf); err != nil {
+			t.Fatal(err)
+		}
+		values := make([]float64, nframes*spf)
+		for i := range values {
+			values[i] = float64(i)
+			if name == "TIME" {
+				values[i] += 1000
+			}
+		}
+		if _, err := GD_putdata(df, name, 0, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := GD_metaflush(df); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeIndexSearch(t *testing.T) {
+	//an index entry every timeIndexStride frames
+	times := []float64{100, 200, 300}
+	for _, c := range []struct {
+		value float64
+		block int
+	}{{50, -1}, {100, -1}, {100.5, 0}, {200, 0}, {250, 1}, {1000, 2}} {
+		if got := searchIndex(times, c.value); got != c.block {
+			t.Errorf("%v: expected block %d got %d", c.value, c.block, got)
+		}
+	}
+	if searchIndex(nil, 5) != -1 {
+		t.Error("expected nothing to search in an empty index")
+	}
+
+	//a block starting at frame 512 with 2 samples per frame
+	samples := []float64{10, 12, 14, 14, 20}
+	for _, c := range []struct {
+		value float64
+		frame float64
+	}{{10, 512}, {11, 512.25}, {14, 513}, {17, 513.75}, {5, 512}} {
+		got, found := searchBlock(samples, c.value, 512, 2)
+		if !found || math.Abs(got-c.frame) > 1e-9 {
+			t.Errorf("%v: expected frame %v got %v (%v)", c.value, c.frame, got, found)
+		}
+	}
+	if _, found := searchBlock(samples, 21, 512, 2); found {
+		t.Error("found a value past the end of the block")
+	}
+}
+
+func TestTimeIndexShrink(t *testing.T) {
+	long, err := GD_open(testDirfile(t, 1000, nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(long)
+	idx := newTimeIndex("TIME")
+	if frame, err := idx.lookup(context.Background(), long, 1600.5); err != nil || frame != 600.5 {
+		t.Fatalf("expected frame 600.5 got %v (%v)", frame, err)
+	}
+
+	//the dirfile starts over shorter with other times, as after a rotation
+	short, err := GD_open(testDirfile(t, 300, nil), GD_open_rw_flags(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(short)
+	times := make([]float64, 300)
+	for i := range times {
+		times[i] = float64(5000 + i)
+	}
+	if _, err := GD_putdata(short, "TIME", 0, times); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := idx.lookup(context.Background(), short, 5100); err != nil || frame != 100 {
+		t.Errorf("expected the index to be rebuilt and give frame 100, got %v (%v)", frame, err)
+	}
+}
+
+func TestTimeIndexTail(t *testing.T) {
+	//the frames are counted with a, TIME lags behind it like a field written last
+	path := t.TempDir() + "/dirfile"
+	df, err := GD_open(path, GD_open_rw_flags(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+	for _, field := range []struct {
+		name string
+		n    int
+	}{{"a", 600}, {"TIME", 300}} {
+		if err := GD_add_raw(df, field.name, 1); err != nil {
+			t.Fatal(err)
+		}
+		values := make([]float64, field.n)
+		for i := range values {
+			values[i] = float64(1000 + i)
+		}
+		if _, err := GD_putdata(df, field.name, 0, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx := newTimeIndex("TIME")
+	if _, err := idx.lookup(context.Background(), df, 1100); err != nil {
+		t.Fatal(err)
+	}
+	if idx.nframes != 512 {
+		t.Errorf("expected the index to stop at the first frame TIME does not have, got %d", idx.nframes)
+	}
+
+	//once TIME catches up the rest gets indexed, even though nframes did not change
+	values := make([]float64, 300)
+	for i := range values {
+		values[i] = float64(1300 + i)
+	}
+	if _, err := GD_putdata(df, "TIME", 300, values); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := idx.lookup(context.Background(), df, 1550); err != nil || frame != 550 {
+		t.Errorf("expected frame 550 got %v (%v)", frame, err)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	path := testDirfile(t, 300, map[string]int{"a": 1})
+	df, err := GD_open(path, GD_open_rw_flags(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+	//room for two whole blocks
+	c := newBlockCache(0)
+	c.budget = 2 * blockFrames * 8
+	read := func(first int) float64 {
+		t.Helper()
+		samples, err := c.getdata(context.Background(), df, "a", first, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return samples[0]
+	}
+
+	read(0)
+	read(1)
+	if stats := c.snapshot(); stats.Misses != 1 || stats.Hits != 1 || stats.Blocks != 1 {
+		t.Errorf("expected a miss then a hit, got %+v", stats)
+	}
+
+	//block 1 is the tail block, 44 frames so far. it is read again once the dirfile grows into it
+	if v := read(260); v != 260 {
+		t.Errorf("expected 260 got %v", v)
+	}
+	for _, name := range []string{"TIME", "a"} {
+		values := make([]float64, 300)
+		for i := range values {
+			values[i] = float64(300 + i)
+		}
+		if _, err := GD_putdata(df, name, 300, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := read(350); v != 350 {
+		t.Errorf("expected the grown tail block to have 350, got %v", v)
+	}
+	if stats := c.snapshot(); stats.Invalidations != 1 || stats.Misses != 3 {
+		t.Errorf("expected the tail block to be invalidated, got %+v", stats)
+	}
+
+	//block 0 was used last, so reading block 2 evicts block 1
+	read(0)
+	read(2 * blockFrames)
+	stats := c.snapshot()
+	if stats.Evictions != 1 || stats.Blocks != 2 || stats.Bytes > stats.BudgetBytes {
+		t.Errorf("expected one eviction within budget, got %+v", stats)
+	}
+	read(0)
+	read(blockFrames)
+	if got := c.snapshot(); got.Hits != stats.Hits+1 || got.Misses != stats.Misses+1 {
+		t.Errorf("expected block 0 kept and block 1 evicted, got %+v after %+v", got, stats)
+	}
+
+	//a read bigger than the whole cache does not go through it
+	if _, err := c.getsamples(context.Background(), df, "a", 0, 600, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.snapshot(); got.Bypasses != 1 {
+		t.Errorf("expected the big read to bypass the cache, got %+v", got)
+	}
+}
+
+func TestQueryDataConcurrent(t *testing.T) {
+	spfs := map[string]int{"a": 1, "b": 10, "c": 25}
+	path := testDirfile(t, 1000, spfs)
+	ds := newDatasource(InitSettings{MaxConcurrentQueries: 2}, GD_open_pool(path, 0, 2))
+	defer ds.Dispose()
+
+	//more queries than handles, over different fields and ranges
+	var queries []backend.DataQuery
+	for i := 0; i < 6; i++ {
+		field := []string{"a", "b", "c"}[i%3]
+		from := time.Unix(int64(1100+100*i), 0)
+		queries = append(queries, backend.DataQuery{
+			RefID:         fmt.Sprint(i),
+			JSON:          []byte(fmt.Sprintf(`{"fieldName":%q,"timeName":"TIME","timeType":true}`, field)),
+			TimeRange:     backend.TimeRange{From: from, To: from.Add(99 * time.Second)},
+			MaxDataPoints: 10000,
+		})
+	}
+	//one at a time first, running them all at once has to give the same
+	alone := map[string]backend.DataResponse{}
+	for _, q := range queries {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{q}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		alone[q.RefID] = resp.Responses[q.RefID]
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, q := range queries {
+		res := resp.Responses[q.RefID]
+		if res.Error != nil {
+			t.Errorf("query %d: %v", i, res.Error)
+			continue
+		}
+		got, want := res.Frames[0].Fields[1], alone[q.RefID].Frames[0].Fields[1]
+		spf := spfs[got.Name]
+		//the field holds its sample number, frame 100+100i is the first one in the range
+		if got.Len() > 0 && got.At(0).(float64) != float64((100+100*i)*spf) {
+			t.Errorf("query %d on %s: expected the first sample %d got %v", i, got.Name, (100+100*i)*spf, got.At(0))
+		}
+		//the samples after the one at the end of the range are trimmed off
+		if got.Len() != 99*spf+1 {
+			t.Errorf("query %d on %s: expected %d samples got %d", i, got.Name, 99*spf+1, got.Len())
+		}
+		if got.Name != want.Name || got.Len() == 0 || got.Len() != want.Len() {
+			t.Errorf("query %d: expected %d samples of %s got %d of %s", i, want.Len(), want.Name, got.Len(), got.Name)
+			continue
+		}
+		for j := 0; j < got.Len(); j++ {
+			if got.At(j) != want.At(j) {
+				t.Errorf("query %d on %s: sample %d is %v, alone it was %v", i, got.Name, j, got.At(j), want.At(j))
+				break
+			}
+		}
+	}
+	if out := ds.readers.checkedOut(); out != 0 {
+		t.Errorf("%d handles were not given back", out)
+	}
+}
+
+func TestDirfilePool(t *testing.T) {
+	path := testDirfile(t, 10, map[string]int{"a": 1})
+	pool := GD_open_pool(path, 0, 2)
+	primary, err := pool.primary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//queries never get the primary handle, the metadata calls use it without asking the pool
+	a, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.df == primary.df || b.df == primary.df || a.df == b.df {
+		t.Fatal("handles are shared")
+	}
+	pool.put(b)
+
+	//closing does not pull the handle from under the query which has it, it goes when it comes back
+	pool.close()
+	if pool.checkedOut() != 1 {
+		t.Errorf("expected the handle to still be checked out, got %d", pool.checkedOut())
+	}
+	if GD_nframes(a) != 10 {
+		t.Errorf("checked out handle stopped working")
+	}
+	pool.put(a)
+	if pool.checkedOut() != 0 || pool.opened != 0 {
+		t.Errorf("expected every handle closed, %d checked out %d open", pool.checkedOut(), pool.opened)
+	}
+	if _, err := pool.get(context.Background()); !errors.Is(err, ErrBadDirfile) {
+		t.Errorf("got a handle from a closed pool: %v", err)
+	}
+	if _, err := pool.primary(); !errors.Is(err, ErrBadDirfile) {
+		t.Errorf("got the primary handle of a closed pool: %v", err)
+	}
+
+	//whoever waits for a handle is let go by close
+	pool = GD_open_pool(path, 0, 1)
+	held, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan error)
+	go func() {
+		_, err := pool.get(context.Background())
+		waiting <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pool.close()
+	select {
+	case err := <-waiting:
+		if !errors.Is(err, ErrBadDirfile) {
+			t.Errorf("expected a closed pool, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not wake the waiting query")
+	}
+	pool.put(held)
+}
+
+func TestSharedHandleErrors(t *testing.T) {
+	//streams, status, health and autocomplete all use the primary handle at the same time,
+	//the error of one call must not show up as the error of another
+	path := testDirfile(t, 10, map[string]int{"a": 4})
+	df, err := GD_open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+
+	const calls = 2000
+	failed := make(chan error, 1)
+	go func() {
+		for i := 0; i < calls; i++ {
+			if _, err := GD_spf_checked(df, "missing"); err == nil {
+				failed <- errors.New("no error for a missing field")
+				return
+			}
+		}
+		failed <- nil
+	}()
+	sample := make([]float64, 1)
+	for i := 0; i < calls; i++ {
+		if spf, err := GD_spf_checked(df, "a"); spf != 4 || err != nil {
+			t.Fatalf("spf of a is %d: %v", spf, err)
+		}
+		if _, err := GD_getdata_c("a", df, 0, 0, 0, 1, sample); err != nil {
+			t.Fatalf("reading a: %v", err)
+		}
+	}
+	if err := <-failed; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	path := testDirfile(t, 1000, map[string]int{"a": 10, "b": 1})
+	query := func(settings InitSettings, ctx context.Context, fields string) backend.DataResponse {
+		ds := newDatasource(settings, GD_open_pool(path, 0, 1))
+		defer ds.Dispose()
+		return ds.query(ctx, backend.PluginContext{}, backend.DataQuery{
+			JSON:          []byte(`{"fieldName":"a","timeName":"TIME","timeType":true` + fields + `}`),
+			TimeRange:     backend.TimeRange{From: time.Unix(1000, 0), To: time.Unix(1999, 0)},
+			MaxDataPoints: 100000,
+		}, "")
+	}
+
+	//a query which runs past the timeout gives up and says so
+	res := query(InitSettings{QueryTimeoutSeconds: 1e-9}, context.Background(), "")
+	if res.Status != backend.StatusTimeout || !strings.Contains(res.Error.Error(), "timed out") {
+		t.Errorf("expected a timeout, got %v %v", res.Status, res.Error)
+	}
+	//and one the dashboard stopped waiting for is cancelled, which is not a bad request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res = query(InitSettings{}, ctx, "")
+	if res.Status != statusCancelled || !strings.Contains(res.Error.Error(), "cancelled") {
+		t.Errorf("expected the query to be cancelled, got %v %v", res.Status, res.Error)
+	}
+
+	//10000 samples of a and 1000 of TIME are more than 5000
+	for _, fields := range []string{"", `,"fieldNames":["b"]`} {
+		res = query(InitSettings{MaxSamples: 5000}, context.Background(), fields)
+		if res.Status != backend.StatusBadRequest || !strings.Contains(res.Error.Error(), "limit of 5000") {
+			t.Errorf("%q: expected the read to be refused, got %v %v", fields, res.Status, res.Error)
+		}
+	}
+	res = query(InitSettings{MaxSamples: 20000}, context.Background(), `,"fieldNames":["b"]`)
+	if res.Error != nil {
+		t.Errorf("read within the limit was refused: %v", res.Error)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	base, err := GD_open_flags(InitSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every option adds its own flag
+	seen := map[uint64]bool{base: true}
+	for _, settings := range []InitSettings{{PrettyPrint: true}, {IgnoreDuplicates: true}, {Verbose: true}, {Encoding: "gzip"}, {Encoding: "none"}} {
+		flags, err := GD_open_flags(settings)
+		if err != nil {
+			t.Fatalf("%+v: %v", settings, err)
+		}
+		if flags&base != base || seen[flags] {
+			t.Errorf("%+v: flags %x do not add to %x", settings, flags, base)
+		}
+		seen[flags] = true
+	}
+	if flags, err := GD_open_flags(InitSettings{Encoding: "gzip"}); err != nil || flags&gdEncodings["gzip"] != gdEncodings["gzip"] {
+		t.Errorf("gzip encoding not in the flags %x (%v)", flags, err)
+	}
+	if flags, err := GD_open_flags(InitSettings{Encoding: "auto"}); err != nil || flags != base {
+		t.Errorf("auto encoding should leave the flags alone, got %x (%v)", flags, err)
+	}
+	if _, err := GD_open_flags(InitSettings{Encoding: "zip"}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected an unknown encoding to be unsupported, got %v", err)
+	}
+	//the datasource refuses settings it can not open the dirfile with
+	if _, err := NewDatasource(backend.DataSourceInstanceSettings{JSONData: []byte(`{"encoding":"zip"}`)}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected the datasource to refuse the encoding, got %v", err)
+	}
+}
+
+func TestDirfilePoolRetry(t *testing.T) {
+	//the run has not started yet
+	path := t.TempDir() + "/dirfile"
+	pool := GD_open_pool(path, 0, 1)
+	defer pool.close()
+	if _, err := pool.primary(); err == nil {
+		t.Fatal("opened a dirfile which is not there")
+	}
+
+	//a dirfile which shows up is not tried again right away
+	writeTestDirfile(t, path, 10, nil)
+	attempt := pool.lastAttempt
+	if _, err := pool.get(context.Background()); err == nil || pool.lastAttempt != attempt {
+		t.Errorf("expected the failed open to be remembered, got %v", err)
+	}
+
+	//but it is once the retry interval is over
+	pool.lastAttempt = pool.lastAttempt.Add(-openRetryInterval)
+	df, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatalf("expected the dirfile to open now: %v", err)
+	}
+	pool.put(df)
+	if primary, err := pool.primary(); err != nil || GD_nframes(primary) != 10 {
+		t.Errorf("primary handle did not open: %v", err)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	path := t.TempDir() + "/dirfile"
+	ds := newDatasource(InitSettings{DatabaseLocation: path, DefaultTimeField: "TIME"}, GD_open_pool(path, 0, 1))
+	defer ds.Dispose()
+	check := func() (*backend.CheckHealthResult, HealthDetails) {
+		t.Helper()
+		res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var details HealthDetails
+		if err := json.Unmarshal(res.JSONDetails, &details); err != nil {
+			t.Fatal(err)
+		}
+		return res, details
+	}
+
+	//the run has not started yet
+	res, details := check()
+	if res.Status != backend.HealthStatusError || details.Path == "" || details.GetdataBuildVersion == "" {
+		t.Errorf("expected an error with the path and version, got %v %q %+v", res.Status, res.Message, details)
+	}
+
+	writeTestDirfile(t, path, 100, map[string]int{"a": 10})
+	ds.readers.lastAttempt = ds.readers.lastAttempt.Add(-openRetryInterval)
+	res, details = check()
+	if res.Status != backend.HealthStatusOk || details.Frames != 100 || details.TimeField != "TIME" {
+		t.Fatalf("unexpected health %v %q %+v", res.Status, res.Message, details)
+	}
+	if !details.TimeStart.Equal(time.Unix(1000, 0)) || !details.TimeEnd.Equal(time.Unix(1099, 0)) {
+		t.Errorf("unexpected time range %v to %v", details.TimeStart, details.TimeEnd)
+	}
+	//the first look can not tell if it grows
+	if details.Growing != nil {
+		t.Errorf("expected growing to be unknown, got %v", *details.Growing)
+	}
+
+	//the next one compares with it, without waiting for the dirfile to grow
+	df, err := GD_open(path, GD_open_rw_flags(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer GD_close(df)
+	for name, spf := range map[string]int{"TIME": 1, "a": 10} {
+		if _, err := GD_putdata(df, name, 100*spf, make([]float64, 10*spf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	res, details = check()
+	if details.Growing == nil || !*details.Growing || !strings.Contains(res.Message, "growing") {
+		t.Errorf("expected the dirfile to be growing, got %q", res.Message)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("health check took %v", time.Since(start))
+	}
+}
+
+func TestDefaultTimeFormat(t *testing.T) {
+	//TIME holds 1000 to 1099, read as milliseconds that is 1s to 1.099s
+	path := testDirfile(t, 100, map[string]int{"a": 1})
+	ds := newDatasource(InitSettings{DatabaseLocation: path, DefaultTimeField: "TIME", DefaultTimeFormat: "unix_ms"}, GD_open_pool(path, 0, 1))
+	defer ds.Dispose()
+	first, last := time.UnixMilli(1000), time.UnixMilli(1099)
+	//milliseconds go through float seconds, so not to the nanosecond
+	near := func(got *time.Time, want time.Time) bool { return got != nil && got.Sub(want).Abs() < time.Microsecond }
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details HealthDetails
+	if err := json.Unmarshal(res.JSONDetails, &details); err != nil {
+		t.Fatal(err)
+	}
+	if !near(details.TimeStart, first) || !near(details.TimeEnd, last) {
+		t.Errorf("expected the health check to report %v to %v, got %v to %v", first, last, details.TimeStart, details.TimeEnd)
+	}
+
+	frame := ds.statusFrame()
+	if got := frame.Fields[3].At(0).(*time.Time); !near(got, last) {
+		t.Errorf("expected the last frame at %v, got %v", last, got)
+	}
+
+	//a query without a time field reads the default one the same way
+	resp := ds.query(context.Background(), backend.PluginContext{}, backend.DataQuery{
+		JSON:          []byte(`{"fieldName":"a","timeType":true}`),
+		TimeRange:     backend.TimeRange{From: first, To: time.UnixMilli(1049)},
+		MaxDataPoints: 1000,
+	}, "")
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if field := resp.Frames[0].Fields[1]; field.Len() != 50 {
+		t.Errorf("expected 50 samples got %d", field.Len())
+	}
+
+	if _, err := NewDatasource(backend.DataSourceInstanceSettings{JSONData: []byte(`{"defaultTimeFormat":"jd"}`)}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected the datasource to refuse the time format, got %v", err)
+	}
+}
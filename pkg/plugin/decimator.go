@@ -0,0 +1,103 @@
+package plugin
+
+// decimator decimates a series which comes in pieces, like a stream does one tick at a time
+// buckets are factor samples long and start at sample numbers which are multiples of factor,
+// so the points do not depend on how the series was cut up: a stream sends the same points
+// as a query over the same range decimated by the same factor
+// a bucket which is not complete yet is kept until the rest of it comes in
+type decimator struct {
+	factor  int
+	mode    string
+	next    int // sample number expected next, anything before it was seen already
+	bucket  int // bucket number of pending, -1 if nothing is pending
+	time    float64
+	pending [][]float64 // samples of the pending bucket, one slice per column
+}
+
+func newDecimator(factor int, mode string) *decimator {
+	if factor < 1 {
+		factor = 1
+	}
+	return &decimator{factor: factor, mode: mode, bucket: -1}
+}
+
+// feed adds samples numbered from start, with their times and one slice of values per column
+// samples which were fed before are skipped. it returns the points of the buckets completed by them
+func (dc *decimator) feed(start int, times []float64, columns [][]float64) ([]float64, [][]float64) {
+	points := len(times)/dc.factor + 2
+	outTimes := make([]float64, 0, points)
+	outColumns := make([][]float64, len(columns))
+	for k := range outColumns {
+		outColumns[k] = make([]float64, 0, points)
+	}
+
+	i := 0
+	if dc.next > start {
+		i = dc.next - start
+	}
+	for i < len(times) {
+		n := start + i
+		b := n / dc.factor
+		//the rest of the bucket, or of what we have of it
+		j := (b+1)*dc.factor - start
+		if j > len(times) {
+			j = len(times)
+		}
+
+		if dc.bucket != b {
+			outTimes, outColumns = dc.emit(outTimes, outColumns)
+			//a bucket which is all in this piece is summarised where it is, only
+			//a bucket which is not complete yet gets copied to wait for the rest
+			if start+j == (b+1)*dc.factor {
+				outTimes = append(outTimes, times[i])
+				for k, column := range columns {
+					outColumns[k] = append(outColumns[k], summarise(column[i:j]).value(dc.mode))
+				}
+				dc.next = start + j
+				i = j
+				continue
+			}
+			dc.bucket = b
+			dc.time = times[i]
+			if len(dc.pending) != len(columns) {
+				dc.pending = make([][]float64, len(columns))
+			}
+		}
+		//the samples are kept rather than a running summary so the mean comes out
+		//exactly the same however the bucket was split
+		for k, column := range columns {
+			dc.pending[k] = append(dc.pending[k], column[i:j]...)
+		}
+		dc.next = start + j
+
+		//complete buckets go out right away
+		if dc.next == (b+1)*dc.factor {
+			outTimes, outColumns = dc.emit(outTimes, outColumns)
+		}
+		i = j
+	}
+	return outTimes, outColumns
+}
+
+// flush gives the point of the bucket still pending, summarising what came in of it so far
+func (dc *decimator) flush() ([]float64, [][]float64) {
+	outTimes := []float64{}
+	outColumns := make([][]float64, len(dc.pending))
+	return dc.emit(outTimes, outColumns)
+}
+
+func (dc *decimator) emit(outTimes []float64, outColumns [][]float64) ([]float64, [][]float64) {
+	if dc.bucket < 0 {
+		return outTimes, outColumns
+	}
+	outTimes = append(outTimes, dc.time)
+	for k, samples := range dc.pending {
+		outColumns[k] = append(outColumns[k], summarise(samples).value(dc.mode))
+	}
+	//the next pending bucket reuses the memory
+	for k := range dc.pending {
+		dc.pending[k] = dc.pending[k][:0]
+	}
+	dc.bucket = -1
+	return outTimes, outColumns
+}
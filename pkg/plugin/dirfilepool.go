@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// default number of DIRFILE handles (and so concurrent queries) per datasource
+const defaultMaxConcurrentQueries = 4
+
+// a dirfile which failed to open does not get tried again more often than this
+const openRetryInterval = 5 * time.Second
+
+// DirfilePool hands out DIRFILE handles all opened on the same path
+// getdata is not thread safe on a single handle but separate handles are independent,
+// so concurrent queries each take their own handle instead of queueing on one mutex
+// handles are opened lazily so a dirfile which does not exist yet (run not started) becomes usable once it shows up
+// the primary handle used for quick metadata calls is kept out of the pool, a query never gets it
+type DirfilePool struct {
+	name        string
+	flags       uint64
+	size        int
+	mutex       *sync.Mutex
+	primaryDf   *Dirfile
+	opened      int // pool handles opened, idle or checked out
+	handles     chan Dirfile
+	lastAttempt time.Time
+	lastErr     error
+	closed      bool
+	done        chan struct{} // closed by close, wakes up whoever waits for a handle
+}
+
+// GD_open_pool tries to open the primary handle right away but does not mind if that fails
+// the pool handles get opened the first time they are needed
+func GD_open_pool(dir_file_name string, flags uint64, size int) *DirfilePool {
+	if size <= 0 {
+		size = defaultMaxConcurrentQueries
+	}
+	p := &DirfilePool{name: dir_file_name, flags: flags, size: size, mutex: &sync.Mutex{}, handles: make(chan Dirfile, size), done: make(chan struct{})}
+	p.primary()
+	return p
+}
+
+// open opens one more handle, the caller must hold the mutex
+func (p *DirfilePool) open() (Dirfile, error) {
+	if p.closed {
+		return Dirfile{}, fmt.Errorf("dirfile %s is closed: %w", p.name, ErrBadDirfile)
+	}
+	if p.lastErr != nil && time.Since(p.lastAttempt) < openRetryInterval {
+		return Dirfile{}, p.lastErr
+	}
+	p.lastAttempt = time.Now()
+	df, err := GD_open(p.name, p.flags)
+	p.lastErr = err
+	return df, err
+}
+
+// primary is the handle used for the quick metadata calls which are not worth queueing for
+// streams, health, status and autocomplete share it, each call holds its mutex until it has read its own error
+func (p *DirfilePool) primary() (Dirfile, error) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+
+	if p.closed {
+		return Dirfile{}, fmt.Errorf("dirfile %s is closed: %w", p.name, ErrBadDirfile)
+	}
+	if p.primaryDf != nil {
+		return *p.primaryDf, nil
+	}
+	df, err := p.open()
+	if err != nil {
+		return Dirfile{}, err
+	}
+	p.primaryDf = &df
+	return df, nil
+}
+
+// get takes a handle out of the pool, opening a new one if all are busy and we are below size
+// otherwise it blocks until one is put back or ctx is done. the handle has to go back with put
+func (p *DirfilePool) get(ctx context.Context) (Dirfile, error) {
+	select {
+	case df := <-p.handles:
+		return df, nil
+	default:
+	}
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return Dirfile{}, fmt.Errorf("dirfile %s is closed: %w", p.name, ErrBadDirfile)
+	}
+	if p.opened < p.size {
+		df, err := p.open()
+		if err == nil {
+			p.opened++
+		}
+		if err == nil || p.opened == 0 {
+			p.mutex.Unlock()
+			return df, err
+		}
+	}
+	p.mutex.Unlock()
+
+	select {
+	case df := <-p.handles:
+		return df, nil
+	case <-ctx.Done():
+		return Dirfile{}, ctx.Err()
+	case <-p.done:
+		return Dirfile{}, fmt.Errorf("dirfile %s is closed: %w", p.name, ErrBadDirfile)
+	}
+}
+
+// put gives a handle from get back, once the pool is closed it gets closed instead
+func (p *DirfilePool) put(df Dirfile) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+
+	if p.closed {
+		GD_close(df)
+		p.opened--
+		return
+	}
+	p.handles <- df
+}
+
+// close closes the primary handle and the idle ones, the pool does not open anything after that
+// handles queries still have checked out get closed when they are put back
+func (p *DirfilePool) close() {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for len(p.handles) > 0 {
+		GD_close(<-p.handles)
+		p.opened--
+	}
+	if p.primaryDf != nil {
+		GD_close(*p.primaryDf)
+		p.primaryDf = nil
+	}
+}
+
+// checkedOut is how many handles queries have at the moment
+func (p *DirfilePool) checkedOut() int {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	return p.opened - len(p.handles)
+}
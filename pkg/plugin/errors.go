@@ -0,0 +1,121 @@
+package plugin
+
+/*
+#include <getdata.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// sentinel errors for the getdata error codes, use errors.Is to check what went wrong
+var (
+	ErrFieldNotFound  = errors.New("field not found")
+	ErrBadDirfile     = errors.New("invalid dirfile")
+	ErrFormat         = errors.New("format file error")
+	ErrIO             = errors.New("i/o error")
+	ErrRange          = errors.New("request out of range")
+	ErrBadFieldType   = errors.New("field type not valid for this operation")
+	ErrBadType        = errors.New("unsupported data type")
+	ErrBadScalar      = errors.New("bad scalar field parameter")
+	ErrAccess         = errors.New("dirfile is read only or protected")
+	ErrUnsupported    = errors.New("unsupported operation or encoding")
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrExists         = errors.New("entry already exists")
+	ErrInternal       = errors.New("internal getdata error")
+)
+
+// what the getdata error codes map to, codes not in here are ErrInternal
+var gdErrorSentinels = map[C.int]error{
+	C.GD_E_BAD_CODE:         ErrFieldNotFound,
+	C.GD_E_BAD_DIRFILE:      ErrBadDirfile,
+	C.GD_E_FORMAT:           ErrFormat,
+	C.GD_E_LINE_TOO_LONG:    ErrFormat,
+	C.GD_E_RECURSE_LEVEL:    ErrFormat,
+	C.GD_E_BAD_REFERENCE:    ErrFormat,
+	C.GD_E_LUT:              ErrFormat,
+	C.GD_E_IO:               ErrIO,
+	C.GD_E_CREAT:            ErrIO,
+	C.GD_E_UNCLEAN_DB:       ErrIO,
+	C.GD_E_RANGE:            ErrRange,
+	C.GD_E_BOUNDS:           ErrRange,
+	C.GD_E_BAD_FIELD_TYPE:   ErrBadFieldType,
+	C.GD_E_DIMENSION:        ErrBadFieldType,
+	C.GD_E_BAD_TYPE:         ErrBadType,
+	C.GD_E_BAD_SCALAR:       ErrBadScalar,
+	C.GD_E_ACCMODE:          ErrAccess,
+	C.GD_E_PROTECTED:        ErrAccess,
+	C.GD_E_UNSUPPORTED:      ErrUnsupported,
+	C.GD_E_UNKNOWN_ENCODING: ErrUnsupported,
+	C.GD_E_ARGUMENT:         ErrInvalidRequest,
+	C.GD_E_BAD_INDEX:        ErrInvalidRequest,
+	C.GD_E_BAD_ENTRY:        ErrInvalidRequest,
+	C.GD_E_DOMAIN:           ErrInvalidRequest,
+	C.GD_E_DUPLICATE:        ErrExists,
+	C.GD_E_EXISTS:           ErrExists,
+}
+
+// GetdataError is what GD_error returns, it keeps the getdata code and message around
+// and unwraps to one of the sentinel errors above
+type GetdataError struct {
+	Code    int
+	Message string
+	kind    error
+}
+
+func newGetdataError(code C.int, message string) *GetdataError {
+	kind, found := gdErrorSentinels[code]
+	if !found {
+		kind = ErrInternal
+	}
+	return &GetdataError{Code: int(code), Message: message, kind: kind}
+}
+
+func (e *GetdataError) Error() string {
+	return e.Message
+}
+
+func (e *GetdataError) Unwrap() error {
+	return e.kind
+}
+
+// errorSource says whose fault an error is, the sdk we are on has no errorsource package yet
+// so this ends up in the status code and the logs
+type errorSource string
+
+const (
+	errorSourceUser   errorSource = "user"   // bad field name, bad range, fix the query
+	errorSourcePlugin errorSource = "plugin" // broken dirfile, io errors, bugs
+)
+
+// classifyError picks the status and source for an error coming out of a read
+func classifyError(err error) (backend.Status, errorSource) {
+	switch {
+	case errors.Is(err, ErrFieldNotFound):
+		return backend.StatusNotFound, errorSourceUser
+	case errors.Is(err, ErrRange), errors.Is(err, ErrBadFieldType), errors.Is(err, ErrBadType),
+		errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrBadScalar):
+		return backend.StatusBadRequest, errorSourceUser
+	case errors.Is(err, ErrAccess):
+		return backend.StatusForbidden, errorSourceUser
+	case errors.Is(err, ErrUnsupported):
+		return backend.StatusNotImplemented, errorSourcePlugin
+	case errors.Is(err, ErrBadDirfile), errors.Is(err, ErrFormat), errors.Is(err, ErrIO):
+		return backend.StatusBadGateway, errorSourcePlugin
+	default:
+		return backend.StatusInternal, errorSourcePlugin
+	}
+}
+
+// describeError gives the message shown in the panel, the getdata message on its own can be cryptic
+func describeError(err error) string {
+	var gdErr *GetdataError
+	if errors.As(err, &gdErr) {
+		return fmt.Sprintf("%s: %s", gdErr.kind, err)
+	}
+	return err.Error()
+}
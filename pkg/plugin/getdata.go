@@ -6,11 +6,25 @@ package plugin
 #cgo LDFLAGS: -L/usr/local/lib -lgetdata
 #include <getdata.h>
 #include <stdlib.h>
+#include <stdint.h>
+
+// defined in health.go, collects format file syntax errors instead of failing the open
+extern int goParserCallback(gd_parser_data_t *pdata, void *extra);
+
+static const char *gd_version_string(void) {
+	return GD_GETDATA_VERSION;
+}
+
+static DIRFILE *gd_cbopen_collect(const char *name, unsigned long flags, uintptr_t handle) {
+	return gd_cbopen(name, flags, goParserCallback, (void *)handle);
+}
 */
 import "C"
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"runtime/cgo"
 	"sync"
 	"unsafe"
 )
@@ -19,58 +33,184 @@ type GD_dirfile *C.DIRFILE
 type Dirfile struct {
 	df    *C.DIRFILE
 	mutex *sync.Mutex
+	name  string
 }
 
-func GD_open(dir_file_name string) Dirfile {
-	//open a dirfile
-	//this is unsafe, does not check success
+func GD_open(dir_file_name string, flags uint64) (Dirfile, error) {
+	//open a dirfile and check that it actually worked
+	//gd_open always gives back a DIRFILE, on failure it is an invalid one which only holds the error
 	var df *C.DIRFILE
 	file_name_c := C.CString(dir_file_name)
 	defer C.free(unsafe.Pointer(file_name_c))
-	df = C.gd_open(file_name_c, C.GD_RDONLY)
-	return Dirfile{df: df, mutex: &sync.Mutex{}}
+	df = C.gd_open(file_name_c, C.ulong(flags))
+	if df == nil {
+		return Dirfile{}, fmt.Errorf("could not open %s: %w", dir_file_name, ErrInternal)
+	}
+
+	res := Dirfile{df: df, mutex: &sync.Mutex{}, name: dir_file_name}
+	if err := GD_error(res); err != nil {
+		C.gd_discard(df)
+		return Dirfile{}, fmt.Errorf("could not open %s: %w", dir_file_name, err)
+	}
+	return res, nil
+}
+
+// GD_open_warnings opens the dirfile like GD_open but carries on past format file syntax errors
+// and returns them as warnings, only meant for diagnostics
+func GD_open_warnings(dir_file_name string, flags uint64) (Dirfile, []string, error) {
+	var warnings []string
+	handle := cgo.NewHandle(&warnings)
+	defer handle.Delete()
+
+	file_name_c := C.CString(dir_file_name)
+	defer C.free(unsafe.Pointer(file_name_c))
+	df := C.gd_cbopen_collect(file_name_c, C.ulong(flags), C.uintptr_t(handle))
+	if df == nil {
+		return Dirfile{}, warnings, fmt.Errorf("could not open %s: %w", dir_file_name, ErrInternal)
+	}
+
+	res := Dirfile{df: df, mutex: &sync.Mutex{}, name: dir_file_name}
+	if err := GD_error(res); err != nil {
+		C.gd_discard(df)
+		return Dirfile{}, warnings, fmt.Errorf("could not open %s: %w", dir_file_name, err)
+	}
+	return res, warnings, nil
+}
+
+// encodings which can be forced in the settings, anything else is left to getdata to detect
+var gdEncodings = map[string]uint64{
+	"none":   C.GD_UNENCODED,
+	"text":   C.GD_TEXT_ENCODED,
+	"slim":   C.GD_SLIM_ENCODED,
+	"gzip":   C.GD_GZIP_ENCODED,
+	"bzip2":  C.GD_BZIP2_ENCODED,
+	"lzma":   C.GD_LZMA_ENCODED,
+	"sie":    C.GD_SIE_ENCODED,
+	"zzip":   C.GD_ZZIP_ENCODED,
+	"zzslim": C.GD_ZZSLIM_ENCODED,
+	"flac":   C.GD_FLAC_ENCODED,
+}
+
+// GD_open_flags turns the datasource settings into the flags for gd_open, always read only
+func GD_open_flags(settings InitSettings) (uint64, error) {
+	var flags uint64 = C.GD_RDONLY
+	if settings.PrettyPrint {
+		flags |= C.GD_PRETTY_PRINT
+	}
+	if settings.IgnoreDuplicates {
+		flags |= C.GD_IGNORE_DUPS
+	}
+	if settings.Verbose {
+		flags |= C.GD_VERBOSE
+	}
+	if settings.Encoding != "" && settings.Encoding != "auto" {
+		encoding, found := gdEncodings[settings.Encoding]
+		if !found {
+			return 0, fmt.Errorf("unknown encoding %s: %w", settings.Encoding, ErrUnsupported)
+		}
+		flags |= encoding | C.GD_FORCE_ENCODING
+	}
+	return flags, nil
+}
+
+// GD_open_rw_flags turns flags from GD_open_flags into flags for a dirfile we write to, creating it if it is not there
+func GD_open_rw_flags(flags uint64) uint64 {
+	return (flags &^ C.GD_RDONLY) | C.GD_RDWR | C.GD_CREAT
 }
 
-func GD_getdata(field_name string, df Dirfile, first_frame, num_frames int) ([]float64, error) {
-	//i got rid of sample calles cause i dont think we need them and not sure what to do with them anyways...
-	//same as GD_getdata_ but gets the size by computing the size from spf and nframes
-	//also it does not need the mutex cause the subcalls have it
+// reads bigger than this many samples get split up so that cancelled queries stop early
+const readChunkSamples = 1 << 20
+
+func GD_getdata_ctx(ctx context.Context, field_name string, df Dirfile, first_frame, num_frames int) ([]float64, error) {
+	//reads whole frames, in chunks so that it gives up as soon as ctx is done
 
 	if num_frames <= 0 {
-		//this is weird, lets not think about it
-		return nil, errors.New("num_frames must be greater than 0")
+		return nil, fmt.Errorf("num_frames must be greater than 0: %w", ErrInvalidRequest)
 	}
 
-	spf := GD_spf(df, field_name)
+	spf, err := GD_spf_checked(df, field_name)
 	nframes := GD_nframes(df)
 
-	//if the first frame is out of bounds, return nil
 	if first_frame >= nframes-1 {
-		return nil, errors.New("first_frame is out of bounds")
+		return nil, fmt.Errorf("first_frame is out of bounds: %w", ErrRange)
 	}
-
-	//get number of frames to read
 	if first_frame+num_frames > nframes {
 		num_frames = nframes - first_frame
 	}
+	if spf == 0 {
+		return nil, err
+	}
+
+	chunkFrames := readChunkSamples / spf
+	if chunkFrames < 1 {
+		chunkFrames = 1
+	}
 
-	//allocate the result array
 	res := make([]float64, num_frames*spf)
+	for frame := 0; frame < num_frames; frame += chunkFrames {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("reading %s: %w", field_name, ctx.Err())
+		}
+		n := chunkFrames
+		if frame+n > num_frames {
+			n = num_frames - frame
+		}
+		if _, err := GD_getdata_c(field_name, df, first_frame+frame, 0, n, 0, res[frame*spf:]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
 
-	// convert the field name to c string
-	field_name_c := C.CString(field_name)
-	defer C.free(unsafe.Pointer(field_name_c))
+func GD_getdata_samples_ctx(ctx context.Context, field_name string, df Dirfile, first_sample, num_samples int, buf []float64) ([]float64, error) {
+	//like GD_getdata_ctx but for a range of samples instead of whole frames
+	//first_sample counts from the start of the dirfile, getdata is fine with it being bigger than spf
+	//the samples are read straight into buf when it is big enough, pass nil to get a new slice
 
-	df.mutex.Lock()
-	C.gd_getdata(df.df, field_name_c, C.long(first_frame), 0, C.ulong(num_frames), 0, C.GD_FLOAT64, unsafe.Pointer(&res[0]))
-	df.mutex.Unlock()
+	if num_samples <= 0 || first_sample < 0 {
+		return nil, fmt.Errorf("bad sample range %d+%d: %w", first_sample, num_samples, ErrInvalidRequest)
+	}
 
-	err := GD_error(df)
+	spf, err := GD_spf_checked(df, field_name)
+	if spf == 0 {
+		return nil, err
+	}
+	nframes := GD_nframes(df)
+	if first_sample+num_samples > nframes*spf {
+		num_samples = nframes*spf - first_sample
+	}
+	if num_samples <= 0 {
+		return nil, fmt.Errorf("first sample is out of bounds: %w", ErrRange)
+	}
 
-	return res, err
+	res := buf[:0]
+	if cap(res) < num_samples {
+		res = make([]float64, num_samples)
+	}
+	res = res[:num_samples]
+	read := 0
+	for read < num_samples {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("reading %s: %w", field_name, ctx.Err())
+		}
+		n := readChunkSamples
+		if read+n > num_samples {
+			n = num_samples - read
+		}
+		got, err := GD_getdata_c(field_name, df, 0, first_sample+read, 0, n, res[read:])
+		if err != nil {
+			return nil, err
+		}
+		read += got
+		if got < n {
+			//field is shorter than nframes says, happens while the writer is mid frame
+			break
+		}
+	}
+	return res[:read], nil
 }
 
-func GD_getdata_c(field_name string, df Dirfile, first_frame, first_sample, num_frames, num_samples int, result []float64) int {
+func GD_getdata_c(field_name string, df Dirfile, first_frame, first_sample, num_frames, num_samples int, result []float64) (int, error) {
 	//leave the responsability of allocating the result array to the caller
 
 	defer df.mutex.Unlock()
@@ -83,28 +223,13 @@ func GD_getdata_c(field_name string, df Dirfile, first_frame, first_sample, num_
 	//pass the result array as a pointer using the first element of result assuming its contiguous
 	numSamples := C.gd_getdata(df.df, field_name_c, C.long(first_frame), C.long(first_sample), C.ulong(num_frames), C.ulong(num_samples), C.GD_FLOAT64, unsafe.Pointer(&result[0]))
 
-	return int(numSamples)
+	return int(numSamples), gdError(df)
 }
 
 func GD_close(df Dirfile) {
 	C.gd_close(df.df)
 }
 
-func GD_framenum(df Dirfile, field_name string, value float64) float64 {
-
-	defer df.mutex.Unlock()
-	df.mutex.Lock()
-
-	field_name_c := C.CString(field_name)
-	defer C.free(unsafe.Pointer(field_name_c))
-
-	var index float64
-
-	index = float64(C.gd_framenum(df.df, field_name_c, C.double(value)))
-
-	return index
-}
-
 func GD_match_entries(df Dirfile, regexString string) []string {
 	//returns a list of all entries in the dirfile
 	//that match the regex string
@@ -135,11 +260,18 @@ func GD_match_entries(df Dirfile, regexString string) []string {
 }
 
 func GD_error(df Dirfile) error {
-
+	//only good for a handle nobody else uses, on a shared one another call can set the error between
+	//ours and this, the wrappers which can fail read it with gdError while they still hold the mutex
 	defer (df.mutex).Unlock()
 	(df.mutex).Lock()
 
-	if C.gd_error(df.df) == 0 {
+	return gdError(df)
+}
+
+// gdError reads the error of the last call on df, the caller must hold the mutex
+func gdError(df Dirfile) error {
+	code := C.gd_error(df.df)
+	if code == 0 {
 		return nil
 	}
 
@@ -152,7 +284,7 @@ func GD_error(df Dirfile) error {
 	// In this case, buflen is ignored. This string will be allocated on the caller's heap and should be deallocated by the caller when no longer needed.
 	C.free(unsafe.Pointer(errorSringPointer))
 
-	return errors.New(errorStringGo)
+	return newGetdataError(code, errorStringGo)
 }
 
 func GD_nframes(df Dirfile) int {
@@ -171,3 +303,162 @@ func GD_spf(df Dirfile, fieldName string) int {
 
 	return int(C.gd_spf(df.df, fieldName_c))
 }
+
+func GD_spf_checked(df Dirfile, fieldName string) (int, error) {
+	//GD_spf with the error of the same call
+	defer (df.mutex).Unlock()
+	(df.mutex).Lock()
+
+	fieldName_c := C.CString(fieldName)
+	defer C.free(unsafe.Pointer(fieldName_c))
+
+	spf := int(C.gd_spf(df.df, fieldName_c))
+
+	return spf, gdError(df)
+}
+
+func GD_build_version() string {
+	//version of the getdata headers we were built against, not necessarily of the library loaded at run time
+	return C.GoString(C.gd_version_string())
+}
+
+func GD_nfields(df Dirfile) int {
+	defer (df.mutex).Unlock()
+	(df.mutex).Lock()
+
+	return int(C.gd_nfields(df.df))
+}
+
+func GD_nfragments(df Dirfile) int {
+	defer (df.mutex).Unlock()
+	(df.mutex).Lock()
+
+	return int(C.gd_nfragments(df.df))
+}
+
+func GD_dirfile_standards(df Dirfile) int {
+	//only asks for the current version, does not change anything
+	defer (df.mutex).Unlock()
+	(df.mutex).Lock()
+
+	return int(C.gd_dirfile_standards(df.df, C.GD_VERSION_CURRENT))
+}
+
+func GD_dirfilename(df Dirfile) string {
+	defer (df.mutex).Unlock()
+	(df.mutex).Lock()
+
+	//the string belongs to getdata, copy it
+	return C.GoString(C.gd_dirfilename(df.df))
+}
+
+func GD_get_constant(df Dirfile, fieldName string) (float64, error) {
+	//reads a CONST entry as a double
+	defer df.mutex.Unlock()
+	df.mutex.Lock()
+
+	fieldName_c := C.CString(fieldName)
+	defer C.free(unsafe.Pointer(fieldName_c))
+
+	var value C.double
+	C.gd_get_constant(df.df, fieldName_c, C.GD_FLOAT64, unsafe.Pointer(&value))
+
+	return float64(value), gdError(df)
+}
+
+// entry types we care about when writing, see gd_entry_type
+const (
+	gdNoEntry     = int(C.GD_NO_ENTRY)
+	gdRawEntry    = int(C.GD_RAW_ENTRY)
+	gdStringEntry = int(C.GD_STRING_ENTRY)
+)
+
+func GD_entry_type(df Dirfile, field_name string) int {
+	//GD_NO_ENTRY when the field does not exist, that also sets the error so dont call GD_error after this
+	defer (df.mutex).Unlock()
+	(df.mutex).Lock()
+
+	field_name_c := C.CString(field_name)
+	defer C.free(unsafe.Pointer(field_name_c))
+
+	return int(C.gd_entry_type(df.df, field_name_c))
+}
+
+func GD_add_raw(df Dirfile, field_name string, spf int) error {
+	//new RAW field of doubles in the first fragment
+	defer df.mutex.Unlock()
+	df.mutex.Lock()
+
+	field_name_c := C.CString(field_name)
+	defer C.free(unsafe.Pointer(field_name_c))
+
+	C.gd_add_raw(df.df, field_name_c, C.GD_FLOAT64, C.uint(spf), 0)
+
+	return gdError(df)
+}
+
+func GD_add_string(df Dirfile, field_name, value string) error {
+	//new STRING entry in the first fragment
+	defer df.mutex.Unlock()
+	df.mutex.Lock()
+
+	field_name_c := C.CString(field_name)
+	defer C.free(unsafe.Pointer(field_name_c))
+	value_c := C.CString(value)
+	defer C.free(unsafe.Pointer(value_c))
+
+	C.gd_add_string(df.df, field_name_c, value_c, 0)
+
+	return gdError(df)
+}
+
+func GD_eof(df Dirfile, field_name string) (int, error) {
+	//number of samples in the field, where the next write goes
+	defer df.mutex.Unlock()
+	df.mutex.Lock()
+
+	field_name_c := C.CString(field_name)
+	defer C.free(unsafe.Pointer(field_name_c))
+
+	eof := int(C.gd_eof(df.df, field_name_c))
+
+	return eof, gdError(df)
+}
+
+func GD_putdata(df Dirfile, field_name string, first_sample int, data []float64) (int, error) {
+	//writes doubles starting at first_sample, getdata converts them to the type of the field
+	if len(data) == 0 {
+		return 0, nil
+	}
+	defer df.mutex.Unlock()
+	df.mutex.Lock()
+
+	field_name_c := C.CString(field_name)
+	defer C.free(unsafe.Pointer(field_name_c))
+
+	written := int(C.gd_putdata(df.df, field_name_c, 0, C.long(first_sample), 0, C.ulong(len(data)), C.GD_FLOAT64, unsafe.Pointer(&data[0])))
+
+	return written, gdError(df)
+}
+
+func GD_flush(df Dirfile, field_name string) error {
+	//pushes the data of one field to disk so readers see it
+	defer df.mutex.Unlock()
+	df.mutex.Lock()
+
+	field_name_c := C.CString(field_name)
+	defer C.free(unsafe.Pointer(field_name_c))
+
+	C.gd_flush(df.df, field_name_c)
+
+	return gdError(df)
+}
+
+func GD_metaflush(df Dirfile) error {
+	//writes out the format file, needed after adding entries
+	defer df.mutex.Unlock()
+	df.mutex.Lock()
+	C.gd_metaflush(df.df)
+
+	return gdError(df)
+}
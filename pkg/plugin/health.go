@@ -0,0 +1,149 @@
+package plugin
+
+/*
+#include <getdata.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"runtime/cgo"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+//export goParserCallback
+func goParserCallback(pdata *C.gd_parser_data_t, extra unsafe.Pointer) C.int {
+	//called by getdata for every syntax error in the format files, see GD_open_warnings
+	warnings := cgo.Handle(uintptr(extra)).Value().(*[]string)
+
+	errorStringPointer := C.gd_error_string(pdata.dirfile, nil, 0)
+	*warnings = append(*warnings, C.GoString(errorStringPointer))
+	C.free(unsafe.Pointer(errorStringPointer))
+
+	//keep parsing, we want all of them
+	return C.GD_SYNTAX_IGNORE
+}
+
+// CheckHealth handles health checks sent from Grafana to the plugin.
+// The main use case for these health checks is the test button on the
+// datasource configuration page which allows users to verify that
+// a datasource is working as expected.
+func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	//lets try reading the time field as it should always be there
+
+	var status = backend.HealthStatusOk
+	var message = "Data source is working"
+
+	details := HealthDetails{Path: d.settings.DatabaseLocation, GetdataBuildVersion: GD_build_version()}
+	if path, err := filepath.Abs(d.settings.DatabaseLocation); err == nil {
+		details.Path = path
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			details.Path = resolved
+		}
+	}
+
+	df, err := d.dirfile()
+	if err != nil {
+		return healthResult(backend.HealthStatusError, fmt.Sprintf("getdata error: %s", describeError(err)), details), nil
+	}
+
+	dummyArray := make([]float64, 1)
+	res, errStr := GD_getdata_c("INDEX", df, 0, 0, 0, 1, dummyArray)
+	if errStr != nil {
+		status = backend.HealthStatusError
+		message = fmt.Sprintf("getdata error: %s", describeError(errStr))
+	} else if res == 0 {
+		status = backend.HealthStatusError
+		message = "getdata error: could not read a single sample of INDEX, is the dirfile empty?"
+	}
+
+	details.StandardsVersion = GD_dirfile_standards(df)
+	details.Fields = GD_nfields(df)
+	details.Fragments = GD_nfragments(df)
+	details.Frames = GD_nframes(df)
+
+	if timeName := d.settings.DefaultTimeField; timeName != "" && details.Frames > 0 {
+		details.TimeField = timeName
+		first, last, err := timeFieldRange(df, timeName, d.settings.DefaultTimeFormat, details.Frames)
+		if err != nil {
+			details.Warnings = append(details.Warnings, fmt.Sprintf("could not read time field %s: %s", timeName, describeError(err)))
+		} else {
+			details.TimeStart = &first
+			details.TimeEnd = &last
+		}
+	}
+
+	//the format files get parsed again on a throw away handle to collect the syntax errors
+	flags, _ := GD_open_flags(d.settings)
+	warningsDf, warnings, err := GD_open_warnings(d.settings.DatabaseLocation, flags)
+	if err == nil {
+		GD_close(warningsDf)
+	}
+	details.Warnings = append(details.Warnings, warnings...)
+
+	details.LeapSecondsUntil = leapSecondsExpire()
+	if time.Now().After(details.LeapSecondsUntil) {
+		details.Warnings = append(details.Warnings, fmt.Sprintf("leap second table expired on %s, set leapSecondsFile to a newer leap-seconds.list", details.LeapSecondsUntil.Format("2006-01-02")))
+	}
+
+	//is someone still writing to it, going by the frames seen the last time anyone looked
+	//(an earlier health check, a status query). the very first look can not tell
+	seenBefore := d.liveness.seenBefore()
+	rate, _ := d.liveness.observe(details.Frames, time.Now())
+	if seenBefore {
+		growing := rate > 0
+		details.Growing = &growing
+	}
+
+	if status == backend.HealthStatusOk {
+		message = fmt.Sprintf("Data source is working: %d fields, %d frames", details.Fields, details.Frames)
+		if details.TimeStart != nil {
+			message += fmt.Sprintf(" from %s to %s", details.TimeStart.Format(time.RFC3339), details.TimeEnd.Format(time.RFC3339))
+		}
+		if details.Growing != nil && *details.Growing {
+			message += ", growing"
+		}
+		if len(details.Warnings) > 0 {
+			message += fmt.Sprintf(". warnings: %s", strings.Join(details.Warnings, "; "))
+		}
+	}
+
+	return healthResult(status, message, details), nil
+}
+
+func healthResult(status backend.HealthStatus, message string, details HealthDetails) *backend.CheckHealthResult {
+	detailsBytes, _ := json.Marshal(details)
+	return &backend.CheckHealthResult{
+		Status:      status,
+		Message:     message,
+		JSONDetails: detailsBytes,
+	}
+}
+
+// timeFieldRange gives the times of the very first and very last samples of a time field stored in format
+func timeFieldRange(df Dirfile, timeName, format string, nframes int) (time.Time, time.Time, error) {
+	spf, err := GD_spf_checked(df, timeName)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	sample := make([]float64, 1)
+	if _, err := GD_getdata_c(timeName, df, 0, 0, 0, 1, sample); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	sample[0] = toUnix(sample[0], format)
+	first := unixSlice2TimeSlice(sample, 0)[0]
+	if _, err := GD_getdata_c(timeName, df, nframes-1, spf-1, 0, 1, sample); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	sample[0] = toUnix(sample[0], format)
+	last := unixSlice2TimeSlice(sample, 0)[0]
+	return first, last, nil
+}
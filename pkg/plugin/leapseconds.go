@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// GPS time started at 1980-01-06 00:00:00 UTC and does not have leap seconds
+const gpsEpochUnix = 315964800
+
+// NTP timestamps count from 1900-01-01
+const ntpUnixEpoch = 2208988800
+
+// the leap-seconds.list published by the IERS (as shipped with tzdata), unchanged so that its #h hash checks out
+// it gets updated by dropping in a newer copy, or at run time with leapSecondsFile
+//
+//go:embed leap-seconds.list
+var embeddedLeapSeconds []byte
+
+type leapSecond struct {
+	unix        float64 // UTC (unix seconds) from which the offset applies
+	taiMinusUTC float64
+}
+
+type leapSecondTable struct {
+	entries  []leapSecond
+	expires  time.Time
+	verified bool // the #h hash of the file matched its contents
+}
+
+// the table in use, shared by every datasource since leap seconds are the same for everyone
+// it starts out as the embedded one and gets replaced when a newer file is loaded
+var (
+	leapSecondsLock = &sync.RWMutex{}
+	leapSeconds     = mustParseLeapSeconds(embeddedLeapSeconds)
+)
+
+func mustParseLeapSeconds(list []byte) leapSecondTable {
+	table, err := parseLeapSeconds("embedded leap-seconds.list", bytes.NewReader(list))
+	if err != nil {
+		panic(fmt.Sprintf("embedded leap second table is broken: %s", err))
+	}
+	return table
+}
+
+// parseLeapSeconds reads a table in the IETF leap-seconds.list format
+// a file whose #h hash does not match (or which has none) is still used but name gets logged,
+// the table may have been edited by hand or cut short
+func parseLeapSeconds(name string, r io.Reader) (leapSecondTable, error) {
+	var table leapSecondTable
+	//the hash covers the numbers of the #$, #@ and data lines, without whitespace and comments
+	hash := sha1.New()
+	var want string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#h") {
+			want = strings.ToLower(strings.Join(strings.Fields(line[2:]), ""))
+			continue
+		}
+		if strings.HasPrefix(line, "#$") {
+			hash.Write([]byte(strings.TrimSpace(line[2:])))
+			continue
+		}
+		if strings.HasPrefix(line, "#@") {
+			ntp, err := strconv.ParseInt(strings.TrimSpace(line[2:]), 10, 64)
+			if err != nil {
+				return table, fmt.Errorf("bad expiry line %q: %w", line, err)
+			}
+			table.expires = time.Unix(ntp-ntpUnixEpoch, 0).UTC()
+			hash.Write([]byte(strings.TrimSpace(line[2:])))
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return table, fmt.Errorf("bad line %q", line)
+		}
+		ntp, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return table, fmt.Errorf("bad line %q: %w", line, err)
+		}
+		offset, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return table, fmt.Errorf("bad line %q: %w", line, err)
+		}
+		table.entries = append(table.entries, leapSecond{unix: float64(ntp - ntpUnixEpoch), taiMinusUTC: offset})
+		hash.Write([]byte(strings.Join(fields, "")))
+	}
+	if err := scanner.Err(); err != nil {
+		return table, err
+	}
+	if len(table.entries) == 0 {
+		return table, errors.New("no leap seconds in table")
+	}
+	table.verified = want == hex.EncodeToString(hash.Sum(nil))
+	if want == "" {
+		backend.Logger.Warn(fmt.Sprintf("%s has no #h hash, it can not be checked for damage", name))
+	} else if !table.verified {
+		backend.Logger.Warn(fmt.Sprintf("%s does not match its #h hash, it may have been edited or cut short", name))
+	}
+	sort.Slice(table.entries, func(i, j int) bool { return table.entries[i].unix < table.entries[j].unix })
+	return table, nil
+}
+
+// loadLeapSeconds reads a leap-seconds.list file and uses it if it is more recent than the table we have
+func loadLeapSeconds(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	table, err := parseLeapSeconds(path, f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	leapSecondsLock.Lock()
+	defer leapSecondsLock.Unlock()
+	if table.expires.After(leapSeconds.expires) {
+		leapSeconds = table
+	}
+	return nil
+}
+
+// leapSecondsExpire says until when the table in use is known to be good
+func leapSecondsExpire() time.Time {
+	leapSecondsLock.RLock()
+	defer leapSecondsLock.RUnlock()
+	return leapSeconds.expires
+}
+
+// taiMinusUTC gives TAI-UTC in seconds at a UTC time, before 1972 we just use the first entry
+func taiMinusUTC(unix float64) float64 {
+	leapSecondsLock.RLock()
+	defer leapSecondsLock.RUnlock()
+
+	entries := leapSeconds.entries
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].unix > unix })
+	if i == 0 {
+		return entries[0].taiMinusUTC
+	}
+	return entries[i-1].taiMinusUTC
+}
+
+// utcToTAI and taiToUTC work in seconds since 1970-01-01, on the UTC and TAI scales respectively
+func utcToTAI(unix float64) float64 {
+	return unix + taiMinusUTC(unix)
+}
+
+// taiToUTC is the inverse of utcToTAI. unix time can not represent the inserted second (23:59:60)
+// so a TAI time inside it comes out as the first second of the next day, like the unix clock does
+func taiToUTC(tai float64) float64 {
+	//the offset at the UTC time we are looking for, one step of correction is enough
+	//since offsets only change by a second at a time
+	unix := tai - taiMinusUTC(tai)
+	return tai - taiMinusUTC(unix)
+}
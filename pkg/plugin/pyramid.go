@@ -0,0 +1,515 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// level L of a pyramid summarises buckets of pyramidFactor^L frames
+const pyramidFactor = 4
+
+// levels with buckets smaller than this many samples are not worth storing, reading raw is cheap enough
+const pyramidMinSamples = 256
+
+// how many base buckets get summarised per read when building a pyramid
+// a pyramid further behind the dirfile than this gets built in the background instead of by the query
+const pyramidBuildBuckets = 64
+
+// default memory budget for all the pyramids of a datasource, can be changed in the settings
+const defaultPyramidMemoryMB = 64
+
+type summary struct {
+	first float64
+	min   float64
+	max   float64
+	mean  float64
+	n     int
+}
+
+const summarySize = 40 // bytes, 4 float64 and an int
+
+// the value of the summary for a given decimation mode, pick just takes the first sample like decimate
+func (s summary) value(mode string) float64 {
+	switch mode {
+	case "mean":
+		return s.mean
+	case "min":
+		return s.min
+	case "max":
+		return s.max
+	default:
+		return s.first
+	}
+}
+
+func summarise(data []float64) summary {
+	s := summary{first: data[0], min: data[0], max: data[0], n: len(data)}
+	sum := 0.0
+	for _, v := range data {
+		s.min = math.Min(s.min, v)
+		s.max = math.Max(s.max, v)
+		sum += v
+	}
+	s.mean = sum / float64(len(data))
+	return s
+}
+
+func combine(summaries []summary) summary {
+	s := summaries[0]
+	sum := s.mean * float64(s.n)
+	for _, o := range summaries[1:] {
+		s.min = math.Min(s.min, o.min)
+		s.max = math.Max(s.max, o.max)
+		sum += o.mean * float64(o.n)
+		s.n += o.n
+	}
+	s.mean = sum / float64(s.n)
+	return s
+}
+
+// pyramid holds min/max/mean summaries of one field at power of pyramidFactor frame buckets
+type pyramid struct {
+	fieldName string
+	spf       int
+	baseLevel int           // level of levels[0]
+	levels    [][]summary   // levels[i] holds the complete buckets of pyramidFactor^(baseLevel+i) frames
+	lastUsed  time.Time     // these three belong to the cache mutex
+	bytes     int           // size as of the last time it was built, for the cache to count without the build lock
+	building  bool          // a background build is on it, queries read raw data meanwhile
+	lock      chan struct{} // held while building or reading, waiting for it gives up with the query's ctx
+}
+
+func newPyramid(fieldName string, spf, base int) *pyramid {
+	return &pyramid{fieldName: fieldName, spf: spf, baseLevel: base, levels: [][]summary{nil}, lock: make(chan struct{}, 1)}
+}
+
+func (p *pyramid) acquire(ctx context.Context) error {
+	select {
+	case p.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for pyramid of %s: %w", p.fieldName, ctx.Err())
+	}
+}
+
+func (p *pyramid) release() {
+	<-p.lock
+}
+
+func bucketFrames(level int) int {
+	return int(math.Pow(pyramidFactor, float64(level)))
+}
+
+// the finest level worth storing for a field with this many samples per frame
+func baseLevel(spf int) int {
+	level := 0
+	for bucketFrames(level)*spf < pyramidMinSamples {
+		level++
+	}
+	return level
+}
+
+// pyramidBytes is about what a pyramid of nframes frames takes from level base up
+func pyramidBytes(nframes, base int) int {
+	return nframes / bucketFrames(base) * summarySize * pyramidFactor / (pyramidFactor - 1)
+}
+
+// behind tells whether the pyramid is more than a build step behind a dirfile of nframes frames, the caller holds its lock
+func (p *pyramid) behind(nframes int) bool {
+	return nframes/bucketFrames(p.baseLevel)-len(p.levels[0]) > pyramidBuildBuckets
+}
+
+func (p *pyramid) size() int {
+	size := 0
+	for _, level := range p.levels {
+		size += len(level) * summarySize
+	}
+	return size
+}
+
+// extend summarises every complete base bucket that was not summarised yet and then rolls them up
+// through the higher levels, only new frames get read
+func (p *pyramid) extend(ctx context.Context, df Dirfile, nframes int) error {
+	baseFrames := bucketFrames(p.baseLevel)
+	bucketSamples := baseFrames * p.spf
+	for bucket := len(p.levels[0]); (bucket+1)*baseFrames <= nframes; {
+		if ctx.Err() != nil {
+			return fmt.Errorf("building pyramid of %s: %w", p.fieldName, ctx.Err())
+		}
+		numBuckets := nframes/baseFrames - bucket
+		if numBuckets > pyramidBuildBuckets {
+			numBuckets = pyramidBuildBuckets
+		}
+		raw, err := readRaw(df, p.fieldName, p.spf, bucket*baseFrames, numBuckets*baseFrames)
+		if err != nil {
+			return err
+		}
+		for i := 0; i+bucketSamples <= len(raw); i += bucketSamples {
+			p.levels[0] = append(p.levels[0], summarise(raw[i:i+bucketSamples]))
+		}
+		bucket += numBuckets
+	}
+
+	//roll the new buckets up the pyramid
+	for i := 0; len(p.levels[i]) >= pyramidFactor; i++ {
+		if i+1 == len(p.levels) {
+			p.levels = append(p.levels, nil)
+		}
+		for j := len(p.levels[i+1]); (j+1)*pyramidFactor <= len(p.levels[i]); j++ {
+			p.levels[i+1] = append(p.levels[i+1], combine(p.levels[i][j*pyramidFactor:(j+1)*pyramidFactor]))
+		}
+	}
+	return nil
+}
+
+// read gives one summary per bucket of the given level for [firstFrame, firstFrame+numFrames)
+// the last bucket of the dirfile is usually not complete yet so it gets summarised from raw data
+func (p *pyramid) read(df Dirfile, level, firstFrame, numFrames, nframes int) ([]summary, error) {
+	frames := bucketFrames(level)
+	complete := p.levels[level-p.baseLevel]
+	first := firstFrame / frames
+	last := (firstFrame + numFrames + frames - 1) / frames
+	if last > len(complete) {
+		last = len(complete)
+	}
+
+	var res []summary
+	if first < last {
+		res = append(res, complete[first:last]...)
+	}
+	if tail := last * frames; tail < firstFrame+numFrames && tail < nframes {
+		raw, err := readRaw(df, p.fieldName, p.spf, tail, nframes-tail)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > 0 {
+			res = append(res, summarise(raw))
+		}
+	}
+	return res, nil
+}
+
+// readRaw reads whole frames of a field, unlike GD_getdata_ctx it is happy to read the very last frame
+func readRaw(df Dirfile, fieldName string, spf, firstFrame, numFrames int) ([]float64, error) {
+	if numFrames <= 0 {
+		return nil, nil
+	}
+	res := make([]float64, numFrames*spf)
+	n, err := GD_getdata_c(fieldName, df, firstFrame, 0, numFrames, 0, res)
+	return res[:n], err
+}
+
+// pyramidCache keeps the pyramids of a datasource within a memory budget
+// the least recently used pyramids get dropped first. the mutex only covers the map and the accounting,
+// each pyramid is built under its own lock. long builds run in the background, outside any query's timeout,
+// on the primary handle, and the queries read raw data until they are done
+type pyramidCache struct {
+	mutex    *sync.Mutex
+	budget   int
+	pyramids map[string]*pyramid
+	open     func() (Dirfile, error) // the handle background builds read with
+	ctx      context.Context         // cancelled by stop
+	cancel   context.CancelFunc
+	running  *sync.WaitGroup
+	stopped  bool
+}
+
+func newPyramidCache(memoryMB int, open func() (Dirfile, error)) *pyramidCache {
+	if memoryMB == 0 {
+		memoryMB = defaultPyramidMemoryMB
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pyramidCache{mutex: &sync.Mutex{}, budget: memoryMB * 1024 * 1024, pyramids: map[string]*pyramid{}, open: open, ctx: ctx, cancel: cancel, running: &sync.WaitGroup{}}
+}
+
+// stop cancels the background builds and waits for them, they must be done reading before the handles go away
+func (c *pyramidCache) stop() {
+	c.mutex.Lock()
+	c.stopped = true
+	c.cancel()
+	c.mutex.Unlock()
+	c.running.Wait()
+}
+
+// buildInBackground builds the pyramids of a query on the cache's handle. the query hands over their locks,
+// unlock releases them, and they are marked as building so other queries do not wait for them
+func (c *pyramidCache) buildInBackground(pyramids []*pyramid, unlock func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopped {
+		unlock()
+		return
+	}
+	for _, p := range pyramids {
+		p.building = true
+	}
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		err := c.buildAll(pyramids)
+		if err != nil && c.ctx.Err() == nil {
+			backend.Logger.Warn(fmt.Sprintf("Could not build pyramid: %s", err))
+		}
+		c.mutex.Lock()
+		for _, p := range pyramids {
+			p.building = false
+		}
+		c.mutex.Unlock()
+		unlock()
+	}()
+}
+
+// buildAll brings pyramids up to date, the caller holds their locks
+func (c *pyramidCache) buildAll(pyramids []*pyramid) error {
+	df, err := c.open()
+	if err != nil {
+		return err
+	}
+	nframes := GD_nframes(df)
+	for _, p := range pyramids {
+		if err := c.build(c.ctx, df, p, nframes); err != nil {
+			return err
+		}
+	}
+	c.trim(pyramids)
+	return nil
+}
+
+// lockPyramids acquires the locks of pyramids always in the same order, so two queries on the same pair can not deadlock
+func lockPyramids(ctx context.Context, pyramids []*pyramid) (func(), error) {
+	locking := append([]*pyramid{}, pyramids...)
+	sort.Slice(locking, func(i, j int) bool { return locking[i].fieldName < locking[j].fieldName })
+	for i, p := range locking {
+		if err := p.acquire(ctx); err != nil {
+			for _, held := range locking[:i] {
+				held.release()
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for _, p := range locking {
+			p.release()
+		}
+	}, nil
+}
+
+// pair gives the pyramids of the time and data field of a query, making empty ones if needed
+// new pyramids start at a base level which lets both of them fit in the budget at once, coarser than
+// baseLevel(spf) if it has to but never coarser than level. ok is false when they can not fit or are being built
+func (c *pyramidCache) pair(names []string, spfs []int, level, nframes int) (res []*pyramid, ok bool) {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	bases := make([]int, len(names))
+	for i, name := range names {
+		bases[i] = baseLevel(spfs[i])
+		if p, found := c.pyramids[name]; found {
+			bases[i] = p.baseLevel
+		}
+	}
+	total := func() int {
+		sum := 0
+		for _, base := range bases {
+			sum += pyramidBytes(nframes, base)
+		}
+		return sum
+	}
+	for total() > c.budget {
+		//the finest new pyramid gives up a level
+		finest := -1
+		for i, name := range names {
+			if _, found := c.pyramids[name]; !found && bases[i] < level && (finest < 0 || bases[i] < bases[finest]) {
+				finest = i
+			}
+		}
+		if finest < 0 {
+			break
+		}
+		bases[finest]++
+	}
+	if total() > c.budget {
+		return nil, false
+	}
+
+	now := time.Now()
+	for i, name := range names {
+		p, found := c.pyramids[name]
+		if !found {
+			p = newPyramid(name, spfs[i], bases[i])
+			c.pyramids[name] = p
+		}
+		p.lastUsed = now
+		res = append(res, p)
+	}
+	for _, p := range res {
+		if p.building {
+			return nil, false
+		}
+	}
+	return res, true
+}
+
+// build brings a pyramid up to date, the caller holds its lock
+func (c *pyramidCache) build(ctx context.Context, df Dirfile, p *pyramid, nframes int) error {
+	err := p.extend(ctx, df, nframes)
+	if err != nil && ctx.Err() == nil {
+		//a cancelled build keeps what it has so far, the next query carries on from there
+		c.mutex.Lock()
+		if c.pyramids[p.fieldName] == p {
+			delete(c.pyramids, p.fieldName)
+		}
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+// trim throws away pyramids until we are within budget. the pyramids of the query in use are kept,
+// the caller holds their locks, if they are still too big together their finest levels go instead
+// pyramids being built in the background are kept too, they are counted once their build trims
+func (c *pyramidCache) trim(inUse []*pyramid) {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	using := map[*pyramid]bool{}
+	for _, p := range inUse {
+		p.bytes = p.size()
+		using[p] = true
+	}
+	total := 0
+	pyramids := make([]*pyramid, 0, len(c.pyramids))
+	for _, p := range c.pyramids {
+		total += p.bytes
+		pyramids = append(pyramids, p)
+	}
+	sort.Slice(pyramids, func(i, j int) bool { return pyramids[i].lastUsed.Before(pyramids[j].lastUsed) })
+	for _, p := range pyramids {
+		if total <= c.budget {
+			return
+		}
+		if using[p] || p.building {
+			continue
+		}
+		total -= p.bytes
+		delete(c.pyramids, p.fieldName)
+	}
+	for total > c.budget {
+		//the biggest finest level of the pyramids in use goes first
+		var biggest *pyramid
+		for _, p := range inUse {
+			if len(p.levels) > 1 && (biggest == nil || len(p.levels[0]) > len(biggest.levels[0])) {
+				biggest = p
+			}
+		}
+		if biggest == nil {
+			return
+		}
+		dropped := len(biggest.levels[0]) * summarySize
+		total -= dropped
+		biggest.bytes -= dropped
+		biggest.levels = biggest.levels[1:]
+		biggest.baseLevel++
+	}
+}
+
+// read serves a decimated read of a time and a data field from the pyramids, it also gives the
+// decimation factor in samples of the data field. the points are the buckets a decimator of that factor makes
+// ok is false when the range is too narrow for the pyramid to help or the pyramid is still being built,
+// the caller should read raw data then
+func (c *pyramidCache) read(ctx context.Context, df Dirfile, timeName, fieldName, mode string, firstFrame, numFrames, maxDataPoints int) (dataSlice, timeSlice []float64, factor int, ok bool, err error) {
+	if c == nil || c.budget < 0 || maxDataPoints <= 0 || numFrames <= 0 {
+		return nil, nil, 0, false, nil
+	}
+
+	// the coarsest level which still gives at least maxDataPoints buckets
+	framesPerPoint := numFrames / maxDataPoints
+	level := 0
+	for bucketFrames(level+1) <= framesPerPoint {
+		level++
+	}
+
+	// dont build anything if the pyramid can not serve this range anyways, zoomed in queries
+	// never touch the pyramids and so never wait for a build
+	names := []string{timeName, fieldName}
+	if timeName == fieldName {
+		names = names[:1]
+	}
+	spfs := make([]int, len(names))
+	for i, name := range names {
+		spf, err := GD_spf_checked(df, name)
+		if err != nil {
+			return nil, nil, 0, false, err
+		}
+		spfs[i] = spf
+		if spfs[i] == 0 || level < baseLevel(spfs[i]) {
+			return nil, nil, 0, false, nil
+		}
+	}
+
+	nframes := GD_nframes(df)
+	pyramids, fits := c.pair(names, spfs, level, nframes)
+	if !fits {
+		return nil, nil, 0, false, nil
+	}
+	unlock, err := lockPyramids(ctx, pyramids)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+
+	//a pyramid which has a lot to catch up on (the first build, mostly) does that in the background,
+	//this query reads raw data. a few new buckets get summarised right here
+	for _, p := range pyramids {
+		if p.behind(nframes) {
+			c.buildInBackground(pyramids, unlock)
+			return nil, nil, 0, false, nil
+		}
+	}
+	defer unlock()
+	for _, p := range pyramids {
+		if err := c.build(ctx, df, p, nframes); err != nil {
+			return nil, nil, 0, false, err
+		}
+	}
+	c.trim(pyramids)
+	timePyramid, dataPyramid := pyramids[0], pyramids[len(pyramids)-1]
+
+	// the budget may have forced us to drop the level we wanted
+	for _, p := range pyramids {
+		if level < p.baseLevel || level-p.baseLevel >= len(p.levels) {
+			return nil, nil, 0, false, nil
+		}
+	}
+
+	dataSummaries, err := dataPyramid.read(df, level, firstFrame, numFrames, nframes)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	timeSummaries, err := timePyramid.read(df, level, firstFrame, numFrames, nframes)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	if len(dataSummaries) != len(timeSummaries) || len(dataSummaries) == 0 {
+		return nil, nil, 0, false, nil
+	}
+
+	// levels are pyramidFactor apart so we may still have a few times too many points, the buckets
+	// get combined in groups lined up on the bucket numbers like the samples of a decimator
+	first := firstFrame / bucketFrames(level)
+	combined := decimationFactor(first, len(dataSummaries), int64(maxDataPoints))
+	for i := 0; i < len(dataSummaries); {
+		end := ((first+i)/combined+1)*combined - first
+		if end > len(dataSummaries) {
+			end = len(dataSummaries)
+		}
+		dataSlice = append(dataSlice, combine(dataSummaries[i:end]).value(mode))
+		timeSlice = append(timeSlice, timeSummaries[i].first)
+		i = end
+	}
+	return dataSlice, timeSlice, bucketFrames(level) * dataPyramid.spf * combined, true, nil
+}
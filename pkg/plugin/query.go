@@ -3,11 +3,14 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
@@ -19,26 +22,37 @@ func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataReques
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
-	// loop over queries and execute them individually.
+	// run the queries side by side, at most as many at once as there are dirfile handles
+	var wg sync.WaitGroup
+	var responseLock sync.Mutex
 	for i, q := range req.Queries {
 		appendString := ""
 		if len(req.Queries) > 1 {
 			appendString = fmt.Sprintf("%d", i)
 		}
-		res := d.query(ctx, req.PluginContext, q, appendString)
-
-		// save the response in a hashmap
-		// based on with RefID as identifier
-		response.Responses[q.RefID] = res
+		wg.Add(1)
+		go func(q backend.DataQuery, appendString string) {
+			defer wg.Done()
+			res := d.query(ctx, req.PluginContext, q, appendString)
+
+			// save the response in a hashmap
+			// based on with RefID as identifier
+			responseLock.Lock()
+			response.Responses[q.RefID] = res
+			responseLock.Unlock()
+		}(q, appendString)
 	}
+	wg.Wait()
 
 	return response, nil
 }
 
 func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, timeAppend string) backend.DataResponse {
 
-	//generatae response object
-	var response backend.DataResponse
+	//liveness of the acquisition rather than data
+	if query.QueryType == "status" {
+		return d.statusQuery(pCtx)
+	}
 
 	// Unmarshal the JSON into our queryModel.
 	var qm QueryModel
@@ -46,111 +60,189 @@ func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, quer
 	err := json.Unmarshal(query.JSON, &qm)
 	if err != nil {
 		//if it fails we really cant do much
-		response.Error = err
-		return response
+		return errorResponse(fmt.Errorf("could not parse query: %v: %w", err, ErrInvalidRequest))
+	}
+
+	//dont let a single query hog a dirfile handle forever
+	if d.settings.QueryTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(d.settings.QueryTimeoutSeconds*float64(time.Second)))
+		defer cancel()
+	}
+
+	//each query gets its own handle so queries running side by side dont wait on each other
+	df, err := d.readers.get(ctx)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer d.readers.put(df)
+
+	if qm.TimeName == "" && d.settings.DefaultTimeField != "" {
+		qm.TimeName = d.settings.DefaultTimeField
+		if qm.TimeFormat == "" {
+			qm.TimeFormat = d.settings.DefaultTimeFormat
+		}
+	}
+	if qm.TimeName == "" {
+		qm.TimeName = "TIME"
+	}
+
+	//time shift moves the window we read, the timestamps get moved back at the end
+	timeShift := time.Duration(0)
+	if qm.TimeShift != "" {
+		timeShift, err = gtime.ParseDuration(qm.TimeShift)
+		if err != nil {
+			return errorResponse(fmt.Errorf("bad time shift %q: %w", qm.TimeShift, ErrInvalidRequest))
+		}
 	}
 
-	//grab the starting time and the end time
-	var numFrames, firstFrame int
+	err = checkTimeFormat(qm.TimeFormat)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = checkInterpolation(qm.Interpolation)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	//a sample rate of 0 means figure it out
+	if qm.IndexByIndex {
+		qm.SampleRate, err = d.resolveSampleRate(ctx, df, qm)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	//grab the starting time and the end time, as fractional frames
+	var firstFrameF, endFrameF float64
 
-	//take a bit more data than u think you need for rounding reasons
-	//this makes sure that the screen gets filled
-	timeFrom := query.TimeRange.From.UnixMilli() / 1e3
-	timeTo := query.TimeRange.To.UnixMilli() / 1e3
+	timeFromExact := float64(query.TimeRange.From.Add(-timeShift).UnixMilli()) / 1e3
+	timeToExact := float64(query.TimeRange.To.Add(-timeShift).UnixMilli()) / 1e3
+
+	nframes := GD_nframes(df)
 
 	if qm.IndexByIndex {
 		// need to find first frame based on start time and num frames based on timerange * sample rate
 		if qm.IndexTimeOffsetType == "fromStart" {
-			firstFrame = int(float64(timeFrom-qm.IndexTimeOffset) * qm.SampleRate)
+			firstFrameF = (timeFromExact - float64(qm.IndexTimeOffset)) * qm.SampleRate
 		} else if qm.IndexTimeOffsetType == "fromEnd" {
-			nFrames := GD_nframes(d.df)
-			firstFrame = nFrames - int(float64(qm.IndexTimeOffset-timeFrom)*qm.SampleRate)
-			// backend.Logger.Info(fmt.Sprintf("index offset: %d, time from: %d, frames: %d, firstFrame: %d", qm.IndexTimeOffset, timeFrom, nFrames, firstFrame))
+			firstFrameF = float64(nframes) - (float64(qm.IndexTimeOffset)-timeFromExact)*qm.SampleRate
 		} else if qm.IndexTimeOffsetType == "fromEndNow" {
-			nFrames := GD_nframes(d.df)
-			firstFrame = nFrames - int(float64(time.Now().Unix()-timeFrom)*qm.SampleRate)
-			// backend.Logger.Info(fmt.Sprintf("Time now: %d, time from: %d, frames: %d, firstFrame: %d", time.Now().Unix(), timeFrom, nFrames, firstFrame))
-		}
-		//get data does not like negative frame numbers
-		if firstFrame < 0 {
-			firstFrame = 0
+			firstFrameF = float64(nframes) - (float64(time.Now().UnixMilli())/1e3-timeFromExact)*qm.SampleRate
 		}
-		numFrames = int(float64(timeTo-timeFrom) * qm.SampleRate)
+		endFrameF = firstFrameF + (timeToExact-timeFromExact)*qm.SampleRate
 
 	} else {
 
-		firstFrame_float := GD_framenum(d.df, qm.TimeName, float64(timeFrom))
-		endFrame := GD_framenum(d.df, qm.TimeName, float64(timeTo))
-
-		//get data does not like negative frame numbers
-		if firstFrame_float < 0 {
-			firstFrame_float = 0
+		firstFrameF, err = d.frameLookup(ctx, df, qm.TimeName, fromUnix(timeFromExact-qm.TimeOffset, qm.TimeFormat))
+		if err != nil {
+			return errorResponse(err)
+		}
+		endFrameF, err = d.frameLookup(ctx, df, qm.TimeName, fromUnix(timeToExact-qm.TimeOffset, qm.TimeFormat))
+		if err != nil {
+			return errorResponse(err)
 		}
-
-		numFrames = int(endFrame - firstFrame_float)
-		firstFrame = int(firstFrame_float)
 	}
 
-	//send an extra frame just in case, never less than 2 frames
-	numFrames++
-	if numFrames < 2 {
-		numFrames = 2
-	}
+	//get data does not like negative frame numbers, or frames which are not there yet
+	firstFrameF = math.Max(0, math.Min(firstFrameF, float64(nframes)))
+	endFrameF = math.Max(firstFrameF, math.Min(endFrameF, float64(nframes)))
 
-	//block of code to make sure that we dont ask for more data than we have
-	lastFrame := GD_nframes(d.df)
-	if firstFrame+numFrames > lastFrame {
-		numFrames = lastFrame - firstFrame
+	//whole frames for the pyramid, it works in frames anyways
+	firstFrame := int(firstFrameF)
+	numFrames := int(math.Ceil(endFrameF)) - firstFrame
+	if numFrames < 1 {
+		numFrames = 1
 	}
 
 	//shoudl figure out the other stuff here like how to compute the number of frames and samples
-	backend.Logger.Info(fmt.Sprintf("frames from: %v, num frames: %v", firstFrame, numFrames))
+	backend.Logger.Info(fmt.Sprintf("frames from: %v to: %v", firstFrameF, endFrameF))
 
-	dataSlice, unixTimeSlice, err := getdata_double(d.df, qm.TimeName, qm.FieldName, firstFrame, numFrames)
-	if err != nil {
-		response.Error = err
-		return response
+	rawFrom := fromUnix(timeFromExact-qm.TimeOffset, qm.TimeFormat)
+	rawTo := fromUnix(timeToExact-qm.TimeOffset, qm.TimeFormat)
+
+	//several fields go in one wide frame sharing the time column
+	fields := qm.fields()
+	if len(fields) > 1 {
+		unixTimeSlice, columns, factor, end, err := d.queryWide(ctx, df, qm, fields, firstFrameF, endFrameF, nframes, rawFrom, rawTo, query.MaxDataPoints)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return d.queryResponse(pCtx, query, qm, timeShift, timeAppend, nframes, fields, factor, end, unixTimeSlice, columns)
 	}
 
-	spf := GD_spf(d.df, qm.FieldName)
-	var decimationFactor int
+	//zoomed out views can be served from the decimation pyramids without touching the raw data,
+	//while a pyramid is still being built they read raw data like any other query
+	dataSlice, unixTimeSlice, factor, fromPyramid, err := d.pyramids.read(ctx, df, qm.TimeName, qm.FieldName, qm.DecimationMode, firstFrame, numFrames, int(query.MaxDataPoints))
+	if err != nil {
+		return errorResponse(err)
+	}
+	//the pyramid covers whole frames, up to the end of the range or of the dirfile
+	end := 0
+	if fromPyramid {
+		end = int(math.Min(float64(firstFrame+numFrames), float64(nframes))) * GD_spf(df, qm.FieldName)
+	}
 
-	maxDataPoints := query.MaxDataPoints // 4 //send 4 times less data than u think u need to
+	if !fromPyramid {
+		timeSpf, err := GD_spf_checked(df, qm.TimeName)
+		if err != nil {
+			return errorResponse(err)
+		}
+		spf, err := GD_spf_checked(df, qm.FieldName)
+		if err != nil {
+			return errorResponse(err)
+		}
+		span := newSampleSpan(firstFrameF, endFrameF, timeSpf, spf, nframes)
+
+		//refuse reads which would take forever, the user should zoom in or let the pyramid do the work
+		if d.settings.MaxSamples > 0 {
+			samples := span.timeNum + span.dataNum
+			if samples > d.settings.MaxSamples {
+				return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("query would read %d samples which is more than the limit of %d, try a shorter time range", samples, d.settings.MaxSamples))
+			}
+		}
 
-	//do we need to decimate
-	if maxDataPoints < int64(len(dataSlice)) {
-		decimationFactor = int(math.Ceil(float64(len(dataSlice)) / float64(maxDataPoints)))
-		decimationFactor = compatibleDecimationFactor(decimationFactor, spf)
-		backend.Logger.Info(fmt.Sprintf("decimation factor: %v", decimationFactor))
-		dataSlice = decimate(dataSlice, decimationFactor)
-	}
-	//we might need to do something with time
-	if len(dataSlice) < len(unixTimeSlice) {
-		//downsample to match
-		unixTimeSlice = decimate(unixTimeSlice, len(unixTimeSlice)/len(dataSlice))
-	} else if len(dataSlice) > len(unixTimeSlice) {
-		//upsample to match
-		unixTimeSlice, err = upsample(unixTimeSlice, len(dataSlice)/len(unixTimeSlice))
+		dataBuf, timeBuf, err := getdata_double_samples(ctx, df, d.blocks, qm.TimeName, qm.FieldName, span)
 		if err != nil {
-			backend.Logger.Error(fmt.Sprintf("Error upsampling time: %v", err))
-			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Error upsampling time: %v", err))
+			return errorResponse(err)
 		}
+		resampledBuf := getBuffer(len(dataBuf))
+		//the frame gets its own copy of the values so the buffers can go back once it is built
+		defer putBuffer(dataBuf)
+		defer putBuffer(timeBuf)
+		defer putBuffer(resampledBuf)
+
+		dataSlice, unixTimeSlice, factor, end = prepareSamples(qm, span, timeSpf, spf, dataBuf, timeBuf, resampledBuf, rawFrom, rawTo, query.MaxDataPoints)
 	}
 
+	return d.queryResponse(pCtx, query, qm, timeShift, timeAppend, nframes, fields, factor, end, unixTimeSlice, [][]float64{dataSlice})
+}
+
+// queryResponse builds the frame for a query out of the time column and one column per field
+// factor is what the points were decimated by, the stream carries on decimating by the same
+// from end, the sample after the last one the points cover, moved back to the start of its bucket
+func (d *Datasource) queryResponse(pCtx backend.PluginContext, query backend.DataQuery, qm QueryModel, timeShift time.Duration, timeAppend string, nframes int, fields []string, factor, end int, unixTimeSlice []float64, columns [][]float64) backend.DataResponse {
+	var response backend.DataResponse
+
 	// decide if we are converting index to time object
-	indexConvert := false
+	indexMode := ""
+	start := 0.0
+	if qm.TimeType && qm.TimeName == "INDEX" && qm.IndexByIndex && isIndexOffsetType(qm.IndexTimeOffsetType) {
+		indexMode = qm.IndexTimeOffsetType
+		start = indexStart(indexMode, float64(qm.IndexTimeOffset), qm.SampleRate, nframes)
+	}
+	//the stream needs the frame rate of any index based query, also when the times come from the time field
 	sampleRateSend := 0.0
-	if qm.TimeType && qm.TimeName == "INDEX" && qm.IndexByIndex && qm.IndexTimeOffsetType == "fromEndNow" {
-		indexConvert = true
+	if qm.IndexByIndex {
 		sampleRateSend = qm.SampleRate
 	}
 
 	var timeSlice interface{}
-	if indexConvert {
-		// indexing by index from end now we can convert index into a time object
-		timeSlice = indexSlice2TimeSlice(unixTimeSlice, qm.SampleRate, query.TimeRange.To)
+	if indexMode != "" {
+		// indexing by index we can convert index into a time object, the time shift moves it back like the time field
+		timeSlice = indexTimes(indexMode, unixTimeSlice, qm.SampleRate, start+timeShift.Seconds(), query.TimeRange.To)
 	} else if qm.TimeType {
-		timeSlice = unixSlice2TimeSlice(unixTimeSlice)
+		timeSlice = unixSlice2TimeSlice(toUnixSlice(unixTimeSlice, qm.TimeFormat), qm.TimeOffset+timeShift.Seconds())
 	} else {
 		timeSlice = unixTimeSlice
 	}
@@ -167,26 +259,93 @@ func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, quer
 		appendString = "__" + timeAppend
 	}
 
-	frame.Fields = append(frame.Fields,
-		data.NewField(qm.TimeName+appendString, nil, timeSlice),
-		data.NewField(qm.FieldName, nil, dataSlice),
-	)
+	frame.Fields = append(frame.Fields, data.NewField(qm.TimeName+appendString, nil, timeSlice))
+	for k, name := range fields {
+		frame.Fields = append(frame.Fields, data.NewField(name, nil, columns[k]))
+	}
 	// Add the "Channel" field to the frame metadata
 	// this should convince grafana to stream
 	// pCtx.DataSourceInstanceSettings.UID
-	if qm.StreamingBool {
+	//a time shifted panel shows old data, there is nothing new to stream
+	if qm.StreamingBool && timeShift == 0 {
 		//turns out the front end is "optimistic" in the interval calculation
 		interval := time.Duration(math.Max(float64(query.Interval.Milliseconds()), float64(query.TimeRange.To.UnixMilli()-query.TimeRange.From.UnixMilli())/float64(query.MaxDataPoints)) * 1e6)
-		channelName := encodeChan(pCtx.DataSourceInstanceSettings.UID, qm.FieldName, interval.String(), qm.TimeName+appendString, qm.TimeType, sampleRateSend)
+		//the last bucket of the query may not be complete, the stream sends it again once it is
+		streamStart := end
+		if factor > 1 {
+			streamStart = end / factor * factor
+		}
+		channelName := encodeChan(pCtx.DataSourceInstanceSettings.UID, StreamRequest{
+			fieldName:      fields[0],
+			fieldNames:     fields[1:],
+			timeNameField:  qm.TimeName + appendString,
+			timeName:       qm.TimeName,
+			interval:       interval,
+			timeType:       qm.TimeType,
+			sampleRate:     sampleRateSend,
+			timeOffset:     qm.TimeOffset,
+			timeFormat:     qm.TimeFormat,
+			interpolation:  qm.Interpolation,
+			decimationMode: qm.DecimationMode,
+			factor:         factor,
+			start:          streamStart,
+			statsWindow:    qm.StatsWindow,
+			indexMode:      indexMode,
+			indexStart:     start,
+		})
 		backend.Logger.Info(fmt.Sprintf("Requesting stream on hannel name: %s", channelName))
 		frame.Meta = &data.FrameMeta{
 			Channel: channelName,
 		}
 	}
 
-	backend.Logger.Info(fmt.Sprintf("Sending: %v, %v values. For querry %+v", len(unixTimeSlice), len(dataSlice), qm))
+	backend.Logger.Info(fmt.Sprintf("Sending: %v, %v values. For querry %+v", len(unixTimeSlice), len(columns[0]), qm))
 
 	//dataSlice and timeSlice are added to the response by the defer call
 
 	return response
 }
+
+// status of a query whose caller went away, the sdk has no name for it so this is nginx's client closed request
+const statusCancelled backend.Status = 499
+
+// errorResponse turns an error from reading the dirfile into a response grafana can make sense of
+func errorResponse(err error) backend.DataResponse {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return backend.ErrDataResponse(backend.StatusTimeout, fmt.Sprintf("query timed out: %v", err))
+	case errors.Is(err, context.Canceled):
+		//nobody is waiting for the answer anymore, this is not the query's fault
+		return backend.ErrDataResponse(statusCancelled, fmt.Sprintf("query cancelled: %v", err))
+	default:
+		status, source := classifyError(err)
+		backend.Logger.Error("query failed", "error", err, "errorSource", source)
+		return backend.ErrDataResponse(status, describeError(err))
+	}
+}
+
+// prepareSamples turns what was read for a query into the points to send: every data sample gets its time,
+// the ends get trimmed to [rawFrom, rawTo] (in the units of the time field) and the rest is decimated down to maxDataPoints
+// resampling happens in the buffers it is given, data is overwritten and timeBuf ends up holding the times,
+// the decimated points (a few per pixel) go in new slices. it also gives the decimation factor
+func prepareSamples(qm QueryModel, span sampleSpan, timeSpf, spf int, data, times, timeBuf []float64, rawFrom, rawTo float64, maxDataPoints int64) ([]float64, []float64, int, int) {
+	//every data sample gets its own time, whatever the spf of the two fields
+	data, times, skipped := resampleTime(times, span.timeFirst, timeSpf, data, span.dataFirst, spf, qm.Interpolation, timeBuf)
+	first := span.dataFirst + skipped
+	columns := [][]float64{data}
+
+	//the span has a time sample of slack either side, cut the data down to exactly what was asked for
+	//index based queries have no unix time to cut with, they keep the slack
+	if !qm.IndexByIndex {
+		var cut int
+		cut, times, columns = trimColumns(times, columns, rawFrom, rawTo)
+		first += cut
+	}
+
+	//time and data line up one to one now so they get decimated together. the factor comes from
+	//the whole span, so it does not depend on how many samples the trimming left
+	factor := streamDecimationFactor(span.dataFirst, span.dataNum, maxDataPoints, spf)
+	end := first + len(times)
+	times, columns = decimateBy(first, times, columns, factor, qm.DecimationMode)
+	return columns[0], times, factor, end
+}
@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// a stream can send this long worth of its limit at once, e.g. after being quiet for a while
+const streamBurst = 5 * time.Second
+
+// roughly what a point costs on the wire: the time and a float64 per column
+const bytesPerValue = 8
+
+// tokenBucket lets rate units per second through on average and up to burst at once
+// taking more than there is leaves it in debt, which the following ticks pay back
+// a nil bucket is no limit
+type tokenBucket struct {
+	mutex  *sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst time.Duration) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	size := rate * burst.Seconds()
+	return &tokenBucket{mutex: &sync.Mutex{}, rate: rate, burst: size, tokens: size}
+}
+
+// refill adds what came in since the last look, the caller holds the mutex
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+b.rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+// available is how many units can go out now
+func (b *tokenBucket) available(now time.Time) float64 {
+	if b == nil {
+		return math.Inf(1)
+	}
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+
+	b.refill(now)
+	return b.tokens
+}
+
+func (b *tokenBucket) take(n float64, now time.Time) {
+	if b == nil {
+		return
+	}
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+
+	b.refill(now)
+	b.tokens -= n
+}
+
+// streamLimits caps the samples (values, not counting the time) and bytes per second sent,
+// either by one stream or by all the streams of the datasource together
+type streamLimits struct {
+	samples *tokenBucket
+	bytes   *tokenBucket
+}
+
+func newStreamLimits(samplesPerSecond, bytesPerSecond int, burst time.Duration) streamLimits {
+	return streamLimits{samples: newTokenBucket(float64(samplesPerSecond), burst), bytes: newTokenBucket(float64(bytesPerSecond), burst)}
+}
+
+// rows is how many points of columns values each fit in the limits now
+func (l streamLimits) rows(columns int, now time.Time) float64 {
+	return math.Min(l.samples.available(now)/float64(columns), l.bytes.available(now)/float64(bytesPerValue*(columns+1)))
+}
+
+func (l streamLimits) take(rows, columns int, now time.Time) {
+	l.samples.take(float64(rows*columns), now)
+	l.bytes.take(float64(rows*bytesPerValue*(columns+1)), now)
+}
+
+// limitStream decimates the points of a tick further when sending them all would go over the limits
+// of the stream or of the datasource. at least one point always goes out so the panel keeps up with
+// the data, a stream over its limits then gets fewer points on the next ticks. the notice says what happened
+func (d *Datasource) limitStream(limits streamLimits, sr StreamRequest, times []float64, columns [][]float64, now time.Time) ([]float64, [][]float64, string) {
+	rows := len(times)
+	allowed := math.Min(limits.rows(len(columns), now), d.streamLimits.rows(len(columns), now))
+	notice := ""
+	if float64(rows) > allowed {
+		maxPoints := int64(math.Max(1, math.Floor(allowed)))
+		times, columns = decimateFrom(0, times, columns, maxPoints, sr.decimationMode)
+		notice = fmt.Sprintf("stream rate limited, %d points sent as %d", rows, len(times))
+	}
+	limits.take(len(times), len(columns), now)
+	d.streamLimits.take(len(times), len(columns), now)
+	return times, columns, notice
+}
+
+// limitNotice puts the notice of limitStream on the frame
+func limitNotice(frame *data.Frame, notice string) {
+	if notice == "" {
+		return
+	}
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Notices = append(frame.Meta.Notices, data.Notice{Severity: data.NoticeSeverityWarning, Text: notice})
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+)
+
+// ways of reading the time field in between its samples, linear is the default
+var interpolations = map[string]bool{
+	"":        true,
+	"linear":  true,
+	"nearest": true,
+	"hold":    true,
+}
+
+func checkInterpolation(mode string) error {
+	if !interpolations[mode] {
+		return fmt.Errorf("unknown interpolation %s: %w", mode, ErrInvalidRequest)
+	}
+	return nil
+}
+
+// resampleTime gives every sample of a data field its own timestamp taken from the time field
+// sample i of a field starting at sample first with spf samples per frame sits at frame (first+i)/spf,
+// the time field is read at that position according to mode. this works for any pair of spf, not just multiples
+// data samples the time field does not cover (before its first sample, or after its last one for linear)
+// get dropped instead of making up a time for them
+// data is compacted in place, the times are written to timeBuf if it is big enough
+// the samples kept are always a contiguous stretch of data, skipped is where it starts
+func resampleTime(times []float64, timeFirst, timeSpf int, data []float64, dataFirst, dataSpf int, mode string, timeBuf []float64) (resampled []float64, resampledTimes []float64, skipped int) {
+	outData := data[:0]
+	outTimes := timeBuf[:0]
+	if cap(outTimes) < len(data) {
+		outTimes = make([]float64, 0, len(data))
+	}
+	if len(times) == 0 || timeSpf <= 0 || dataSpf <= 0 {
+		return outData, outTimes, 0
+	}
+
+	for j, value := range data {
+		//position in samples of the time field, kept as a fraction num/dataSpf so equal positions match exactly
+		num := (dataFirst+j)*timeSpf - timeFirst*dataSpf
+		i := int(math.Floor(float64(num) / float64(dataSpf)))
+		rest := num - i*dataSpf
+
+		var t float64
+		switch mode {
+		case "nearest":
+			if 2*rest >= dataSpf {
+				i++
+			}
+			if i < 0 || i >= len(times) {
+				continue
+			}
+			t = times[i]
+		case "hold":
+			if i < 0 || i >= len(times) {
+				continue
+			}
+			t = times[i]
+		default:
+			if i < 0 || i >= len(times) || (rest != 0 && i+1 >= len(times)) {
+				continue
+			}
+			t = times[i]
+			if rest != 0 {
+				frac := float64(rest) / float64(dataSpf)
+				t = times[i]*(1-frac) + times[i+1]*frac
+			}
+		}
+		if len(outData) == 0 {
+			skipped = j
+		}
+		outData = append(outData, value)
+		outTimes = append(outTimes, t)
+	}
+	return outData, outTimes, skipped
+}
+
+// resampleValues is the other way around from resampleTime: it reads a data field at the position of
+// every sample of the time field, so several fields can share one time column
+// n samples of the time field starting at timeFirst, the data read starts at sample dataFirst
+// positions the data does not cover come out as NaN
+func resampleValues(data []float64, dataFirst, dataSpf, timeFirst, timeSpf, n int, mode string) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = math.NaN()
+		if timeSpf <= 0 || dataSpf <= 0 {
+			continue
+		}
+		//position in samples of the data field, as the fraction num/timeSpf
+		num := (timeFirst+i)*dataSpf - dataFirst*timeSpf
+		j := int(math.Floor(float64(num) / float64(timeSpf)))
+		rest := num - j*timeSpf
+
+		switch mode {
+		case "nearest":
+			if 2*rest >= timeSpf {
+				j++
+			}
+			if j >= 0 && j < len(data) {
+				out[i] = data[j]
+			}
+		case "hold":
+			if j >= 0 && j < len(data) {
+				out[i] = data[j]
+			}
+		default:
+			if j < 0 || j >= len(data) {
+				continue
+			}
+			if rest == 0 {
+				out[i] = data[j]
+			} else if j+1 < len(data) {
+				frac := float64(rest) / float64(timeSpf)
+				out[i] = data[j]*(1-frac) + data[j+1]*frac
+			}
+		}
+	}
+	return out
+}
+
+// summariseValues is resampleValues for a data field faster than the time field when decimating by
+// mean, min or max: every time sample gets the summary of the data samples from its position up to
+// the position of the next time sample, so no data sample is skipped before decimating
+func summariseValues(data []float64, dataFirst, dataSpf, timeFirst, timeSpf, n int, mode string) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = math.NaN()
+		if timeSpf <= 0 || dataSpf <= 0 {
+			continue
+		}
+		//the data samples at or after this time sample and before the next one
+		start := ((timeFirst+i)*dataSpf+timeSpf-1)/timeSpf - dataFirst
+		end := ((timeFirst+i+1)*dataSpf+timeSpf-1)/timeSpf - dataFirst
+		if start < 0 {
+			start = 0
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		if start < end {
+			out[i] = summarise(data[start:end]).value(mode)
+		}
+	}
+	return out
+}
+
+// summarisesValues says if a wide read should use summariseValues for a field
+func summarisesValues(dataSpf, timeSpf int, mode string) bool {
+	return dataSpf > timeSpf && (mode == "mean" || mode == "min" || mode == "max")
+}
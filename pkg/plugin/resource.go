@@ -12,13 +12,29 @@ import (
 /// Resrouce handler which serves the autocomplete endpoint. will autocomplete queries ************************
 
 func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	switch req.Path {
+	case "cache-stats":
+		return d.cacheStats(sender)
+	default:
+		return d.autocomplete(req, sender)
+	}
+}
+
+func (d *Datasource) autocomplete(req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
 	var reqGo AutocompleteRequest
 
 	json.Unmarshal(req.Body, &reqGo)
 
 	backend.Logger.Info(fmt.Sprintf("interpreted %s", reqGo.RegexString))
 
-	matchList := GD_match_entries(d.df, reqGo.RegexString)
+	df, err := d.dirfile()
+	if err != nil {
+		return sender.Send(&backend.CallResourceResponse{
+			Status: http.StatusServiceUnavailable,
+			Body:   []byte(err.Error()),
+		})
+	}
+	matchList := GD_match_entries(df, reqGo.RegexString)
 
 	response := AutocompleteResponse{MatchList: matchList}
 	responseBytes, _ := json.Marshal(response)
@@ -28,3 +44,13 @@ func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResource
 		Body:   responseBytes,
 	})
 }
+
+// cacheStats reports how well the block cache is doing, useful to tune blockCacheMB
+func (d *Datasource) cacheStats(sender backend.CallResourceResponseSender) error {
+	responseBytes, _ := json.Marshal(d.blocks.snapshot())
+
+	return sender.Send(&backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Body:   responseBytes,
+	})
+}
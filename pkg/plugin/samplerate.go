@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// how many of the most recent frames get looked at to guess the frame rate
+const sampleRateFrames = 64
+
+// guessed frame rates are good for this long, the acquisition rarely changes rate but it can
+const sampleRateTTL = time.Minute
+
+type sampleRateEntry struct {
+	rate float64
+	at   time.Time
+}
+
+// resolveSampleRate gives the frame rate (frames per second) to use for index based queries
+// the query wins if it has one, then the CONST entry from the settings, then a guess from the time field
+func (d *Datasource) resolveSampleRate(ctx context.Context, df Dirfile, qm QueryModel) (float64, error) {
+	if qm.SampleRate > 0 {
+		return qm.SampleRate, nil
+	}
+
+	if d.settings.SampleRateField != "" {
+		rate, err := GD_get_constant(df, d.settings.SampleRateField)
+		if err != nil {
+			return 0, fmt.Errorf("reading sample rate from %s: %w", d.settings.SampleRateField, err)
+		}
+		if rate > 0 {
+			return rate, nil
+		}
+	}
+
+	//INDEX can not tell us anything about time, fall back to the default time field
+	timeName, timeFormat := qm.TimeName, qm.TimeFormat
+	if timeName == "" || timeName == "INDEX" {
+		timeName, timeFormat = d.settings.DefaultTimeField, d.settings.DefaultTimeFormat
+	}
+	if timeName == "" || timeName == "INDEX" {
+		return 0, fmt.Errorf("no sample rate given and no time field to infer it from: %w", ErrInvalidRequest)
+	}
+
+	if entry, found := d.sampleRates.Load(timeName); found && time.Since(entry.(sampleRateEntry).at) < sampleRateTTL {
+		return entry.(sampleRateEntry).rate, nil
+	}
+	rate, err := inferSampleRate(ctx, df, d.blocks, timeName, timeFormat)
+	if err != nil {
+		return 0, err
+	}
+	d.sampleRates.Store(timeName, sampleRateEntry{rate: rate, at: time.Now()})
+	return rate, nil
+}
+
+// inferSampleRate guesses the frame rate from the median time step over the most recent frames
+// the median does not care about the odd dropped frame or glitch
+func inferSampleRate(ctx context.Context, df Dirfile, cache *blockCache, timeName, timeFormat string) (float64, error) {
+	nframes := GD_nframes(df)
+	numFrames := sampleRateFrames
+	if numFrames > nframes-1 {
+		numFrames = nframes - 1
+	}
+	if numFrames < 1 {
+		return 0, fmt.Errorf("not enough frames to infer the sample rate from %s: %w", timeName, ErrRange)
+	}
+	spf, err := GD_spf_checked(df, timeName)
+	if err != nil {
+		return 0, err
+	}
+
+	times, err := cache.getdata(ctx, df, timeName, nframes-1-numFrames, numFrames)
+	if err != nil {
+		return 0, err
+	}
+	rate, err := medianFrameRate(toUnixSlice(times, timeFormat), spf)
+	if err != nil {
+		return 0, fmt.Errorf("inferring sample rate from %s: %w", timeName, err)
+	}
+	return rate, nil
+}
+
+func medianFrameRate(times []float64, spf int) (float64, error) {
+	if len(times) < 2 || spf < 1 {
+		return 0, errors.New("need at least two samples")
+	}
+	deltas := make([]float64, len(times)-1)
+	for i := range deltas {
+		deltas[i] = times[i+1] - times[i]
+	}
+	sort.Float64s(deltas)
+	median := deltas[len(deltas)/2]
+	if median <= 0 {
+		return 0, errors.New("time field is not increasing")
+	}
+	return 1 / (median * float64(spf)), nil
+}
@@ -0,0 +1,242 @@
+package plugin
+
+import (
+	"context"
+	"math"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// what a statistics stream sends for every field, in this order
+var streamStatistics = []string{"mean", "rms", "min", "max", "rate"}
+
+type statSample struct {
+	x, v float64
+}
+
+// rollingStats keeps the statistics of the samples in the last window (in units of x) up to date
+// as samples come in. sums are updated as samples enter and leave the window, min and max come
+// from monotonic queues, so adding a sample is O(1) on average whatever the window holds
+type rollingStats struct {
+	window  float64
+	samples []statSample // in the window, oldest first, from head on
+	head    int
+	removed int     // samples left the window since the sums were last recomputed
+	x0      float64 // x is taken relative to this in the sums, keeps the slope precise
+	sum     float64
+	sumSq   float64
+	sumX    float64
+	sumXX   float64
+	sumXV   float64
+	minQ    []statSample // increasing values, the min at the front
+	maxQ    []statSample // decreasing values, the max at the front
+}
+
+func newRollingStats(window float64) *rollingStats {
+	return &rollingStats{window: window}
+}
+
+// add puts a sample in the window and drops the ones which are now older than the window
+// samples have to come in order of x. NaN (no data) is ignored
+func (s *rollingStats) add(x, v float64) {
+	if math.IsNaN(v) || math.IsNaN(x) {
+		return
+	}
+	if s.head == len(s.samples) {
+		s.x0 = x
+	}
+	s.samples = append(s.samples, statSample{x, v})
+	s.accumulate(x, v, 1)
+
+	for len(s.minQ) > 0 && s.minQ[len(s.minQ)-1].v >= v {
+		s.minQ = s.minQ[:len(s.minQ)-1]
+	}
+	s.minQ = append(s.minQ, statSample{x, v})
+	for len(s.maxQ) > 0 && s.maxQ[len(s.maxQ)-1].v <= v {
+		s.maxQ = s.maxQ[:len(s.maxQ)-1]
+	}
+	s.maxQ = append(s.maxQ, statSample{x, v})
+
+	cutoff := x - s.window
+	for s.samples[s.head].x < cutoff {
+		old := s.samples[s.head]
+		s.accumulate(old.x, old.v, -1)
+		s.head++
+		s.removed++
+	}
+	for s.minQ[0].x < cutoff {
+		s.minQ = s.minQ[1:]
+	}
+	for s.maxQ[0].x < cutoff {
+		s.maxQ = s.maxQ[1:]
+	}
+
+	//subtracting what leaves the window slowly loses precision, start over once it all turned over
+	if s.removed >= len(s.samples)-s.head {
+		s.recompute()
+	}
+}
+
+func (s *rollingStats) accumulate(x, v, sign float64) {
+	dx := x - s.x0
+	s.sum += sign * v
+	s.sumSq += sign * v * v
+	s.sumX += sign * dx
+	s.sumXX += sign * dx * dx
+	s.sumXV += sign * dx * v
+}
+
+// recompute drops the samples which left the window for good and redoes the sums from scratch
+func (s *rollingStats) recompute() {
+	s.samples = append(s.samples[:0], s.samples[s.head:]...)
+	s.head = 0
+	s.removed = 0
+	s.sum, s.sumSq, s.sumX, s.sumXX, s.sumXV = 0, 0, 0, 0, 0
+	if len(s.samples) == 0 {
+		return
+	}
+	s.x0 = s.samples[0].x
+	for _, sample := range s.samples {
+		s.accumulate(sample.x, sample.v, 1)
+	}
+}
+
+// values gives the statistics in the order of streamStatistics, NaN when there is not enough data.
+// rate is the slope of a least squares line through the window, per unit of x
+func (s *rollingStats) values() []float64 {
+	res := make([]float64, len(streamStatistics))
+	n := float64(len(s.samples) - s.head)
+	if n == 0 {
+		for i := range res {
+			res[i] = math.NaN()
+		}
+		return res
+	}
+	res[0] = s.sum / n
+	res[1] = math.Sqrt(math.Max(0, s.sumSq/n))
+	res[2] = s.minQ[0].v
+	res[3] = s.maxQ[0].v
+	res[4] = math.NaN()
+	if denominator := n*s.sumXX - s.sumX*s.sumX; n > 1 && denominator > 0 {
+		res[4] = (n*s.sumXV - s.sumX*s.sum) / denominator
+	}
+	return res
+}
+
+// streamStats is the state of a statistics stream, one rollingStats per field
+type streamStats struct {
+	fields []*rollingStats
+	next   int // first sample not added yet, samples read again next tick are not counted twice
+	spf    int
+	last   float64 // time of the newest sample added
+}
+
+func newStreamStats(sr StreamRequest) *streamStats {
+	st := &streamStats{}
+	for range sr.fields() {
+		st.fields = append(st.fields, newRollingStats(sr.statsWindow))
+	}
+	return st
+}
+
+// statsX puts the times of a stream in the unit of the window: seconds, or the
+// time field itself when it is not a time
+func statsX(sr StreamRequest, times []float64) []float64 {
+	if sr.indexMode != "" {
+		res := make([]float64, len(times))
+		for i, t := range times {
+			res[i] = t / sr.sampleRate
+		}
+		return res
+	}
+	if sr.timeType {
+		return toUnixSlice(times, sr.timeFormat)
+	}
+	return times
+}
+
+// statsTick adds what was written since lastFrame to the windows and gives the frame with the
+// statistics, nil if nothing new came in. also gives the frame to read from next tick
+func (d *Datasource) statsTick(ctx context.Context, df Dirfile, sr StreamRequest, st *streamStats, lastFrame, newFrame int) (*data.Frame, int, error) {
+	first, spf, times, columns, release, err := d.streamRead(ctx, df, sr, lastFrame, newFrame)
+	if err != nil {
+		return nil, lastFrame, err
+	}
+	defer release()
+	if st.spf == 0 {
+		st.spf = spf
+	}
+
+	skip := 0
+	if st.next > first {
+		skip = st.next - first
+	}
+	if skip >= len(times) {
+		return nil, lastFrame, nil
+	}
+	xs := statsX(sr, times[skip:])
+	for k, column := range columns {
+		for i, x := range xs {
+			st.fields[k].add(x, column[skip+i])
+		}
+	}
+	st.next = first + len(times)
+	st.last = times[len(times)-1]
+
+	resumeFrame := newFrame
+	if st.spf > 0 && st.next/st.spf < newFrame {
+		resumeFrame = st.next / st.spf
+	}
+	if resumeFrame < lastFrame {
+		resumeFrame = lastFrame
+	}
+	return statsFrame(sr, st), resumeFrame, nil
+}
+
+// statsFrame is the one row frame a statistics stream sends, at the time of the newest sample
+func statsFrame(sr StreamRequest, st *streamStats) *data.Frame {
+	frame := data.NewFrame("response")
+	frame.Fields = append(frame.Fields, data.NewField(sr.timeNameField, nil, streamTimes(sr, []float64{st.last})))
+	for k, name := range sr.fields() {
+		for i, value := range st.fields[k].values() {
+			frame.Fields = append(frame.Fields, data.NewField(name+" "+streamStatistics[i], nil, []float64{value}))
+		}
+	}
+	return frame
+}
+
+// statsStart is the frame a statistics stream starts reading from, so the first update already
+// covers a whole window. without a sample rate we can not tell and start from the newest frame
+func (d *Datasource) statsStart(ctx context.Context, df Dirfile, sr StreamRequest) int {
+	nframes := GD_nframes(df)
+	//the window is in units of the time field when that is not a time, there is no telling how many frames that is
+	if sr.indexMode == "" && !sr.timeType {
+		return nframes - 1
+	}
+	frameRate := sr.sampleRate
+	if frameRate == 0 && sr.timeType {
+		rate, err := inferSampleRate(ctx, df, d.blocks, sr.timeName, sr.timeFormat)
+		if err == nil {
+			frameRate = rate
+		}
+	}
+	if frameRate <= 0 {
+		return nframes - 1
+	}
+	frames := int(math.Ceil(sr.statsWindow * frameRate))
+	//a long window on a fast dirfile should not turn into a read which takes forever
+	if d.settings.MaxSamples > 0 {
+		perFrame := GD_spf(df, sr.timeName)
+		for _, name := range sr.fields() {
+			perFrame += GD_spf(df, name)
+		}
+		if perFrame > 0 && frames*perFrame > d.settings.MaxSamples {
+			frames = d.settings.MaxSamples / perFrame
+		}
+	}
+	start := nframes - 1 - frames
+	if start < 0 {
+		return 0
+	}
+	return start
+}
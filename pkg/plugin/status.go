@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// path of the channel with the status of the acquisition, ds/<uid>/status
+const statusChannelPath = "status"
+
+// how often the status channel sends a heartbeat
+const statusInterval = 5 * time.Second
+
+// after this long without new frames the status carries a warning
+const staleAfter = 30 * time.Second
+
+// liveness keeps track of how the dirfile grows, from every look at nframes the status channel takes
+type liveness struct {
+	mutex   *sync.Mutex
+	frames  int
+	seen    time.Time // when frames was seen
+	changed time.Time // when frames last went up
+	rate    float64   // frames per second between the last two looks which saw new frames
+}
+
+func newLiveness() *liveness {
+	return &liveness{mutex: &sync.Mutex{}}
+}
+
+// seenBefore says if observe was called before, only then can it tell whether frames went up
+func (l *liveness) seenBefore() bool {
+	defer l.mutex.Unlock()
+	l.mutex.Lock()
+
+	return !l.seen.IsZero()
+}
+
+// observe records nframes as seen at now and gives the frame rate and the time since frames last went up
+func (l *liveness) observe(nframes int, now time.Time) (float64, time.Duration) {
+	defer l.mutex.Unlock()
+	l.mutex.Lock()
+
+	switch {
+	case l.seen.IsZero():
+		l.changed = now
+	case nframes > l.frames:
+		if dt := now.Sub(l.seen).Seconds(); dt > 0 {
+			l.rate = float64(nframes-l.frames) / dt
+		}
+		l.changed = now
+	case nframes < l.frames:
+		//dirfile got replaced or truncated, start over
+		l.rate = 0
+		l.changed = now
+	default:
+		//nothing new, the rate we report goes down the longer that lasts
+		if now.Sub(l.changed) > 2*statusInterval {
+			l.rate = 0
+		}
+	}
+	l.frames = nframes
+	l.seen = now
+	return l.rate, now.Sub(l.changed)
+}
+
+// statusFrame is one row describing the acquisition: how far it got and whether it is still going
+func (d *Datasource) statusFrame() *data.Frame {
+	now := time.Now()
+	frame := data.NewFrame("status")
+	path := d.settings.DatabaseLocation
+
+	df, err := d.dirfile()
+	if err != nil {
+		frame.Fields = append(frame.Fields,
+			data.NewField("time", nil, []time.Time{now}),
+			data.NewField("path", nil, []string{path}),
+		)
+		frame.Meta = &data.FrameMeta{Notices: []data.Notice{{Severity: data.NoticeSeverityError, Text: fmt.Sprintf("dirfile not available: %s", describeError(err))}}}
+		return frame
+	}
+
+	nframes := GD_nframes(df)
+	rate, sinceNew := d.liveness.observe(nframes, now)
+
+	//the time of the newest sample, if there is a time field to read it from
+	var lastFrameTime *time.Time
+	timeName, timeFormat := d.settings.DefaultTimeField, d.settings.DefaultTimeFormat
+	if timeName == "" {
+		timeName, timeFormat = "TIME", ""
+	}
+	if nframes > 0 {
+		if _, last, err := timeFieldRange(df, timeName, timeFormat, nframes); err == nil {
+			lastFrameTime = &last
+		}
+	}
+
+	frame.Fields = append(frame.Fields,
+		data.NewField("time", nil, []time.Time{now}),
+		data.NewField("path", nil, []string{path}),
+		data.NewField("frames", nil, []int64{int64(nframes)}),
+		data.NewField("lastFrameTime", nil, []*time.Time{lastFrameTime}),
+		data.NewField("framesPerSecond", nil, []float64{math.Round(rate*1000) / 1000}),
+		data.NewField("secondsSinceNewData", nil, []float64{math.Round(sinceNew.Seconds())}),
+	)
+	if sinceNew > staleAfter {
+		frame.Meta = &data.FrameMeta{Notices: []data.Notice{{Severity: data.NoticeSeverityWarning, Text: fmt.Sprintf("no new data for %s", sinceNew.Round(time.Second))}}}
+	}
+	return frame
+}
+
+// statusQuery answers a query of type status with the current status, streaming the heartbeats after it
+func (d *Datasource) statusQuery(pCtx backend.PluginContext) backend.DataResponse {
+	frame := d.statusFrame()
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	if pCtx.DataSourceInstanceSettings != nil {
+		frame.Meta.Channel = fmt.Sprintf("ds/%s/%s", pCtx.DataSourceInstanceSettings.UID, statusChannelPath)
+	}
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
+
+// runStatus is RunStream for the status channel, it sends a status frame every statusInterval
+func (d *Datasource) runStatus(ctx context.Context, sender *backend.StreamSender) error {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			d.senderLock.Lock()
+			err := sender.SendFrame(d.statusFrame(), data.IncludeAll)
+			d.senderLock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"time"
@@ -17,16 +18,101 @@ func (d *Datasource) SubscribeStream(ctx context.Context, request *backend.Subsc
 	backend.Logger.Info("SubscribeStream called")
 	status := backend.SubscribeStreamStatusOK
 
-	//write down the last frame
-	d.lastFrame.Store(request.Path, GD_nframes(d.df)-1)
+	//the status channel starts with the current status so a panel has something to show right away
+	if request.Path == statusChannelPath {
+		initial, err := backend.NewInitialFrame(d.statusFrame(), data.IncludeAll)
+		if err != nil {
+			return nil, err
+		}
+		return &backend.SubscribeStreamResponse{Status: status, InitialData: initial}, nil
+	}
+
+	//the path comes from the browser, make sure it is one of ours before doing anything with it
+	sr, err := decodeChan(request.Path)
+	if err != nil {
+		backend.Logger.Warn(fmt.Sprintf("Refusing stream: %s", err))
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+
+	df, err := d.dirfile()
+	if err != nil {
+		backend.Logger.Warn(fmt.Sprintf("Refusing stream %s, dirfile not available: %s", request.Path, err))
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+
+	//and that the fields are actually in the dirfile
+	spfs := map[string]int{}
+	for _, name := range append(sr.fields(), sr.timeName) {
+		spf, err := GD_spf_checked(df, name)
+		if spf == 0 {
+			backend.Logger.Warn(fmt.Sprintf("Refusing stream %s, no field %s: %v", request.Path, name, err))
+			return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+		}
+		spfs[name] = spf
+	}
+
+	//statistics start a window back so the first update is over a whole window, there is nothing to backfill
+	if sr.statsWindow > 0 {
+		if !d.streams.active(request.Path) {
+			d.lastFrame.Store(request.Path, d.statsStart(ctx, df, sr))
+		}
+		return &backend.SubscribeStreamResponse{Status: status}, nil
+	}
+
+	//a subscriber coming back after a disconnect gets what it missed first
+	initial, backfilledTo, err := d.backfill(ctx, df, sr, request.Data)
+	if err != nil {
+		backend.Logger.Warn(fmt.Sprintf("Could not backfill stream %s: %s", request.Path, err))
+	}
+	if backfilledTo >= 0 {
+		//live updates carry on from the end of the backfill, unless the stream is already running for others
+		if d.streams.active(request.Path) {
+			d.lastFrame.LoadOrStore(request.Path, backfilledTo)
+		} else {
+			d.lastFrame.Store(request.Path, backfilledTo)
+		}
+		return &backend.SubscribeStreamResponse{Status: status, InitialData: initial}, nil
+	}
+
+	//a stream which is already running for others carries on where it is
+	if !d.streams.active(request.Path) {
+		d.lastFrame.Store(request.Path, streamStartFrame(sr, spfs, GD_nframes(df)))
+	}
 
 	return &backend.SubscribeStreamResponse{Status: status}, nil
 }
 
+// streamStartFrame is the frame a new stream reads from first: the one holding the sample the query
+// stopped at, channels which do not say start a frame before the end of the dirfile
+func streamStartFrame(sr StreamRequest, spfs map[string]int, nframes int) int {
+	//wide streams decimate samples of the time field
+	spf := spfs[sr.fieldName]
+	if len(sr.fieldNames) > 0 {
+		spf = spfs[sr.timeName]
+	}
+	if sr.start <= 0 || spf <= 0 {
+		return nframes - 1
+	}
+	return sr.start / spf
+}
+
 func (d *Datasource) RunStream(ctx context.Context, request *backend.RunStreamRequest, sender *backend.StreamSender) error {
 
 	var err error
 
+	//keep track of the stream so Dispose can stop it, the state of the channel goes away with it
+	ctx, done, err := d.streams.start(ctx, request.Path, func() {
+		d.lastFrame.Delete(request.Path)
+	})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if request.Path == statusChannelPath {
+		return d.runStatus(ctx, sender)
+	}
+
 	sr, err := decodeChan(request.Path)
 	if err != nil {
 		return err
@@ -37,8 +123,19 @@ func (d *Datasource) RunStream(ctx context.Context, request *backend.RunStreamRe
 	if tickerInterval < 1*time.Second {
 		tickerInterval = 3 * time.Second
 	}
+	//statistics are one row, a stat panel should not wait for a point worth of samples to update
+	if sr.statsWindow > 0 {
+		tickerInterval = time.Second
+	}
 	ticker := time.NewTicker(tickerInterval)
 
+	//the decimator carries buckets which are not complete yet from one tick to the next
+	//and the statistics the samples in the window
+	dec := &streamDecimator{}
+	stats := newStreamStats(sr)
+	//a stream ticking slower than the burst still gets a whole tick worth at once
+	limits := newStreamLimits(d.settings.StreamSamplesPerSecond, d.settings.StreamBytesPerSecond, time.Duration(math.Max(float64(streamBurst), float64(tickerInterval))))
+
 	var newFrame int
 	for {
 		select {
@@ -47,8 +144,14 @@ func (d *Datasource) RunStream(ctx context.Context, request *backend.RunStreamRe
 			ticker.Stop()
 			return err
 		case <-ticker.C:
+			df, err := d.dirfile()
+			if err != nil {
+				backend.Logger.Info(fmt.Sprintf("Dirfile not available on stream %s: %s", request.Path, err))
+				continue
+			}
+
 			//check if there is new data
-			newFrame = GD_nframes(d.df)
+			newFrame = GD_nframes(df)
 			lastFrameInterface, found := d.lastFrame.Load(request.Path)
 			if !found {
 				backend.Logger.Info("odd, did not subscribe properly")
@@ -64,95 +167,197 @@ func (d *Datasource) RunStream(ctx context.Context, request *backend.RunStreamRe
 			}
 
 			//new data if we got here
-			//grab the data and error check
-			dataSlice, unixTimeSlice, err := getdata_double(d.df, sr.timeName, sr.fieldName, lastFrame, newFrame-lastFrame)
+			var frame *data.Frame
+			var resumeFrame int
+			if sr.statsWindow > 0 {
+				frame, resumeFrame, err = d.statsTick(ctx, df, sr, stats, lastFrame, newFrame)
+			} else {
+				var unixTimeSlice []float64
+				var columns [][]float64
+				unixTimeSlice, columns, resumeFrame, err = d.streamTick(ctx, df, sr, dec, lastFrame, newFrame, tickerInterval)
+				if len(unixTimeSlice) > 0 {
+					var notice string
+					unixTimeSlice, columns, notice = d.limitStream(limits, sr, unixTimeSlice, columns, time.Now())
+					frame = streamFrame(sr, unixTimeSlice, columns)
+					limitNotice(frame, notice)
+				}
+			}
 			if err != nil {
 				backend.Logger.Error(err.Error())
 				return err
 			}
 
-			//lets do a check to see that there is actually data, if not update the lastframe so it does not happen again
-			if dataSlice == nil && unixTimeSlice == nil {
-				backend.Logger.Info("No data, but frame number went up, strange...")
-				d.lastFrame.Store(request.Path, newFrame)
-				continue
-			}
-
-			// check what the interval is
-			// if it is less than the interval of the stream, then we need to decimate
-
-			spf := GD_spf(d.df, sr.fieldName)
-
-			dataInterval := tickerInterval.Seconds() / float64(len(dataSlice))
-			// dataInterval = dataInterval / 4 //just to be safe
-			if dataInterval < sr.interval.Seconds() {
-				//decimate the data by a factor which is either a divisor or a multiple of spf
-				decimationFactor := int(math.Ceil(sr.interval.Seconds() / dataInterval))
-				decimationFactor = compatibleDecimationFactor(decimationFactor, spf)
-				//if the decimation factor is larger than the data slice, then just send one value
-				dataSlice = decimate(dataSlice, decimationFactor)
-			}
-			//adjust x axis to match
-			if len(dataSlice) < len(unixTimeSlice) {
-				//etiher downsample
-				unixTimeSlice = decimate(unixTimeSlice, len(unixTimeSlice)/len(dataSlice))
-			} else if len(dataSlice) > len(unixTimeSlice) {
-				//or upsample
-				if len(unixTimeSlice) == 1 {
-					//hard to upsample with just one data point, lets grab another one from the past
-					//this call is guaranteed to give 2 data points  since calling it with 1 gave exactly 1
-					unixTimeSlice, err = GD_getdata(sr.timeName, d.df, newFrame-2, 2)
-					if err != nil {
-						backend.Logger.Error(err.Error())
-						return err
-					}
-				}
-				unixTimeSlice, err = upsample(unixTimeSlice, len(dataSlice)/len(unixTimeSlice))
+			if frame != nil {
+				d.senderLock.Lock()
+				err = sender.SendFrame(frame, data.IncludeAll)
+				d.senderLock.Unlock()
 				if err != nil {
-					backend.Logger.Error(fmt.Sprintf("Error upsampling time in stream: %s", err))
+					backend.Logger.Info(fmt.Sprintf("Error sending frame: %v", err))
 					return err
 				}
+				backend.Logger.Info(fmt.Sprintf("Sending frame on endpoint: %s with %v values", request.Path, frame.Rows()))
 			}
 
-			//create the response objects out here
+			//update the last frame
+			d.lastFrame.Store(request.Path, resumeFrame)
 
-			var timeSlice interface{}
-			if sr.sampleRate != 0 {
-				// indexing by index from end now we can convert index into a time object
-				// backend.Logger.Info("comparing a float to an int worked shockingly", sampleRate)
-				timeSlice = indexSlice2TimeSlice(unixTimeSlice, sr.sampleRate, time.Now())
-			} else if sr.timeType {
-				timeSlice = unixSlice2TimeSlice(unixTimeSlice)
-			} else {
-				timeSlice = unixTimeSlice
-			}
+		}
+	}
+}
 
-			//create frame object
-			frame := data.NewFrame("response")
-			frame.Fields = append(frame.Fields,
-				data.NewField(sr.timeNameField, nil, timeSlice),
-				data.NewField(sr.fieldName, nil, dataSlice),
-			)
+// streamDecimator is the decimator of a running stream, it gets made on the first tick with data
+// once we know how many samples make a point
+type streamDecimator struct {
+	*decimator
+	spf int // samples per frame of what is decimated
+}
 
-			d.senderLock.Lock()
-			err = sender.SendFrame(frame, data.IncludeAll)
-			d.senderLock.Unlock()
-			if err != nil {
-				backend.Logger.Info(fmt.Sprintf("Error sending frame: %v", err))
-				return err
-			}
-			backend.Logger.Info(fmt.Sprintf("Sending frame on endpoint: %s with %v values", request.Path, len(dataSlice)))
+// streamTick reads what was written since lastFrame and decimates it, giving the points to send
+// and the frame to read from next tick. samples which have no time yet (the time field is written
+// a bit behind) are read again next tick, the decimator knows not to send them twice
+func (d *Datasource) streamTick(ctx context.Context, df Dirfile, sr StreamRequest, dec *streamDecimator, lastFrame, newFrame int, tickerInterval time.Duration) ([]float64, [][]float64, int, error) {
+	first, spf, unixTimeSlice, columns, release, err := d.streamRead(ctx, df, sr, lastFrame, newFrame)
+	if err != nil {
+		return nil, nil, lastFrame, err
+	}
+	//the decimator copies what it keeps
+	defer release()
 
-			//update the last frame
-			d.lastFrame.Store(request.Path, newFrame)
+	if dec.decimator == nil {
+		dec.decimator = newDecimator(d.streamFactor(ctx, df, sr, spf, len(unixTimeSlice), tickerInterval), sr.decimationMode)
+		dec.spf = spf
+		//the samples of the frame before where the query stopped were sent with the query
+		dec.next = sr.start
+	}
+	unixTimeSlice, columns = dec.feed(first, unixTimeSlice, columns)
 
+	//carry on from the frame holding the first sample not seen yet
+	resumeFrame := newFrame
+	if dec.next > 0 && dec.spf > 0 && dec.next/dec.spf < newFrame {
+		resumeFrame = dec.next / dec.spf
+	}
+	if resumeFrame < lastFrame {
+		resumeFrame = lastFrame
+	}
+	return unixTimeSlice, columns, resumeFrame, nil
+}
+
+// streamRead reads frames [lastFrame, newFrame) of a stream with a time for every sample. it gives
+// the sample number of the first one and the samples per frame the sample numbers count in.
+// the columns may sit in a pooled buffer, call release once done with them
+func (d *Datasource) streamRead(ctx context.Context, df Dirfile, sr StreamRequest, lastFrame, newFrame int) (first, spf int, times []float64, columns [][]float64, release func(), err error) {
+	release = func() {}
+	timeSpf, err := GD_spf_checked(df, sr.timeName)
+	if err != nil {
+		return 0, 0, nil, nil, release, err
+	}
+
+	if len(sr.fieldNames) > 0 {
+		//several fields go out as one wide frame, the time field is only read once for all of them
+		first, times, columns, err = d.streamColumns(ctx, df, sr, lastFrame, newFrame)
+		return first, timeSpf, times, columns, release, err
+	}
+
+	spf, err = GD_spf_checked(df, sr.fieldName)
+	if err != nil {
+		return 0, 0, nil, nil, release, err
+	}
+	span := sampleSpan{
+		timeFirst: lastFrame * timeSpf, timeNum: (newFrame - lastFrame) * timeSpf,
+		dataFirst: lastFrame * spf, dataNum: (newFrame - lastFrame) * spf,
+	}
+	dataBuf, timeBuf, err := getdata_double_samples(ctx, df, d.blocks, sr.timeName, sr.fieldName, span)
+	if err != nil {
+		return 0, 0, nil, nil, release, err
+	}
+	//the values are compacted in place in dataBuf, the times go to a new slice
+	values, times, skipped := resampleTime(timeBuf, span.timeFirst, timeSpf, dataBuf, span.dataFirst, spf, sr.interpolation, nil)
+	putBuffer(timeBuf)
+	return span.dataFirst + skipped, spf, times, [][]float64{values}, func() { putBuffer(dataBuf) }, nil
+}
+
+// streamFactor is how many samples make a point of the stream, the factor the query decimated by
+// so the stream carries on with the density of the panel. channels from before the query passed it on
+// get at most one point per interval, the sample rate comes from the query or the time field, failing
+// that from what came in this tick
+func (d *Datasource) streamFactor(ctx context.Context, df Dirfile, sr StreamRequest, spf, samples int, tickerInterval time.Duration) int {
+	if sr.factor > 0 {
+		return sr.factor
+	}
+	if sr.interval <= 0 {
+		return 1
+	}
+	frameRate := sr.sampleRate
+	if frameRate == 0 && sr.timeType {
+		rate, err := inferSampleRate(ctx, df, d.blocks, sr.timeName, sr.timeFormat)
+		if err == nil {
+			frameRate = rate
 		}
 	}
+	samplesPerSecond := frameRate * float64(spf)
+	if samplesPerSecond <= 0 {
+		samplesPerSecond = float64(samples) / tickerInterval.Seconds()
+	}
+	factor := int(math.Ceil(sr.interval.Seconds() * samplesPerSecond))
+	if factor < 1 {
+		return 1
+	}
+	//buckets which are a divisor or a multiple of a frame
+	return compatibleDecimationFactor(factor, spf)
+}
+
+// streamColumns reads frames [first, last) of every field of a stream, sharing the time column
+// it also gives the sample number of the time field the columns start at
+func (d *Datasource) streamColumns(ctx context.Context, df Dirfile, sr StreamRequest, first, last int) (int, []float64, [][]float64, error) {
+	timeSpf, err := GD_spf_checked(df, sr.timeName)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	times, columns, err := getdata_wide(ctx, df, d.blocks, sr.timeName, sr.fields(), first*timeSpf, (last-first)*timeSpf, sr.interpolation, sr.decimationMode)
+	return first * timeSpf, times, columns, err
+}
+
+// streamFrame puts the time column and the field columns of a stream in the frame sent to grafana
+func streamFrame(sr StreamRequest, unixTimeSlice []float64, columns [][]float64) *data.Frame {
+	frame := data.NewFrame("response")
+	frame.Fields = append(frame.Fields, data.NewField(sr.timeNameField, nil, streamTimes(sr, unixTimeSlice)))
+	for k, name := range sr.fields() {
+		frame.Fields = append(frame.Fields, data.NewField(name, nil, columns[k]))
+	}
+	return frame
+}
+
+// streamTimes turns the values of the time field into the time column of a stream frame
+func streamTimes(sr StreamRequest, unixTimeSlice []float64) interface{} {
+	if sr.indexMode != "" {
+		return indexTimes(sr.indexMode, unixTimeSlice, sr.sampleRate, sr.indexStart, time.Now())
+	} else if sr.timeType {
+		return unixSlice2TimeSlice(toUnixSlice(unixTimeSlice, sr.timeFormat), sr.timeOffset)
+	}
+	return unixTimeSlice
 }
 
 func (d *Datasource) PublishStream(ctx context.Context, request *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
-	// Implement data publishing logic here
+	//only annotations can be published, they go to their own dirfile and never to the one being read
 	backend.Logger.Info("PublishStream called")
-	status := backend.PublishStreamStatusPermissionDenied
-	return &backend.PublishStreamResponse{Status: status}, nil
+	if request.Path != annotationsChannelPath {
+		return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusNotFound}, nil
+	}
+	user := request.PluginContext.User
+	if d.annotations == nil || !canPublish(d.settings, user) {
+		return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+	}
+
+	var req PublishRequest
+	if err := json.Unmarshal(request.Data, &req); err != nil {
+		return nil, fmt.Errorf("could not decode annotation: %s: %w", err, ErrInvalidRequest)
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if err := d.annotations.write(req, time.Now()); err != nil {
+		return nil, fmt.Errorf("could not write annotation %s: %w", req.Field, err)
+	}
+	backend.Logger.Info(fmt.Sprintf("%s published annotation %s", user.Login, req.Field))
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusOK}, nil
 }
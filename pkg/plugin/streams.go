@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// streamRegistry keeps track of the RunStream calls in progress
+// grafana stops a stream by cancelling its context, but when the datasource gets disposed
+// we have to stop them ourselves before the dirfile handles they read from are closed
+type streamRegistry struct {
+	mutex   *sync.Mutex
+	streams map[string]*activeStream // channel path -> stream running on it
+	running *sync.WaitGroup
+	stopped bool
+}
+
+type activeStream struct {
+	cancel context.CancelFunc
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{mutex: &sync.Mutex{}, streams: map[string]*activeStream{}, running: &sync.WaitGroup{}}
+}
+
+// start registers a stream on path, the returned context gets cancelled by stop
+// done has to be called once the stream returns, it calls cleanup unless another stream took over the path
+func (r *streamRegistry) start(ctx context.Context, path string, cleanup func()) (context.Context, func(), error) {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	if r.stopped {
+		return nil, nil, fmt.Errorf("datasource is shutting down: %w", ErrBadDirfile)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &activeStream{cancel: cancel}
+	//grafana runs one stream per channel, one still registered on the path is on its way out
+	if old, found := r.streams[path]; found {
+		old.cancel()
+	}
+	r.streams[path] = stream
+	r.running.Add(1)
+
+	done := func() {
+		cancel()
+		r.mutex.Lock()
+		if r.streams[path] == stream {
+			delete(r.streams, path)
+			cleanup()
+		}
+		r.mutex.Unlock()
+		r.running.Done()
+	}
+	return ctx, done, nil
+}
+
+// active says if a stream is running on path
+func (r *streamRegistry) active(path string) bool {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+	_, found := r.streams[path]
+	return found
+}
+
+// count gives the number of streams running
+func (r *streamRegistry) count() int {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+	return len(r.streams)
+}
+
+// stop cancels every stream and waits for them to return, no new ones get started afterwards
+func (r *streamRegistry) stop() {
+	r.mutex.Lock()
+	r.stopped = true
+	for _, stream := range r.streams {
+		stream.cancel()
+	}
+	r.mutex.Unlock()
+
+	r.running.Wait()
+}
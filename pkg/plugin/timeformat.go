@@ -0,0 +1,78 @@
+package plugin
+
+import "fmt"
+
+// MJD 40587 is 1970-01-01
+const mjdUnixEpoch = 40587
+
+// time field encodings understood by TimeFormat in the query, unix (seconds) is the default
+var timeFormats = map[string]bool{
+	"":        true,
+	"unix":    true,
+	"unix_ms": true,
+	"unix_us": true,
+	"unix_ns": true,
+	"gps":     true,
+	"mjd":     true,
+	"tai":     true,
+}
+
+func checkTimeFormat(format string) error {
+	if !timeFormats[format] {
+		return fmt.Errorf("unknown time format %s: %w", format, ErrInvalidRequest)
+	}
+	return nil
+}
+
+// toUnix converts a value of the time field to unix seconds (UTC)
+// gps is seconds since the GPS epoch, tai is seconds since 1970 counted in TAI, mjd is UTC days
+func toUnix(value float64, format string) float64 {
+	switch format {
+	case "unix_ms":
+		return value / 1e3
+	case "unix_us":
+		return value / 1e6
+	case "unix_ns":
+		return value / 1e9
+	case "mjd":
+		return (value - mjdUnixEpoch) * 86400
+	case "gps":
+		return taiToUTC(value + utcToTAI(gpsEpochUnix))
+	case "tai":
+		return taiToUTC(value)
+	default:
+		return value
+	}
+}
+
+// fromUnix is the inverse of toUnix, used to look up the requested time range in the time field
+func fromUnix(unix float64, format string) float64 {
+	switch format {
+	case "unix_ms":
+		return unix * 1e3
+	case "unix_us":
+		return unix * 1e6
+	case "unix_ns":
+		return unix * 1e9
+	case "mjd":
+		return unix/86400 + mjdUnixEpoch
+	case "gps":
+		return utcToTAI(unix) - utcToTAI(gpsEpochUnix)
+	case "tai":
+		return utcToTAI(unix)
+	default:
+		return unix
+	}
+}
+
+// toUnixSlice converts a whole slice of the time field, unix is returned as is
+func toUnixSlice(values []float64, format string) []float64 {
+	if format == "" || format == "unix" {
+		return values
+	}
+	res := make([]float64, len(values))
+	for i, v := range values {
+		res[i] = toUnix(v, format)
+	}
+	return res
+}
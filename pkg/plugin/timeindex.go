@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// every timeIndexStride frames we remember the first sample of the time field
+// a lookup then only needs one read of at most timeIndexStride frames
+const timeIndexStride = 256
+
+// timeIndex is a sparse, lazily built index of a time field
+// it assumes the time field is monotonically increasing which is the whole point of a time field
+type timeIndex struct {
+	fieldName string
+	mutex     *sync.Mutex
+	spf       int
+	times     []float64 // time of the first sample of frame i*timeIndexStride
+	nframes   int       // frames the index covers, the tail frames of the time field may not be written yet
+}
+
+func newTimeIndex(fieldName string) *timeIndex {
+	return &timeIndex{fieldName: fieldName, mutex: &sync.Mutex{}}
+}
+
+// timeIndexFor returns the cached index for a time field, creating an empty one if needed
+func (d *Datasource) timeIndexFor(fieldName string) *timeIndex {
+	idx, _ := d.timeIndexes.LoadOrStore(fieldName, newTimeIndex(fieldName))
+	return idx.(*timeIndex)
+}
+
+// frameLookup is the replacement for GD_framenum, it resolves a time to a (fractional) frame
+// using the cached sparse index and a single bounded read
+func (d *Datasource) frameLookup(ctx context.Context, df Dirfile, timeName string, value float64) (float64, error) {
+	return d.timeIndexFor(timeName).lookup(ctx, df, value)
+}
+
+// refresh extends the index to cover all the frames currently in the dirfile
+// only the frames added since the last call get read
+func (idx *timeIndex) refresh(ctx context.Context, df Dirfile) error {
+	nframes := GD_nframes(df)
+	if nframes < idx.nframes {
+		//truncated or replaced by a new run, nothing we know about it holds anymore
+		idx.times = nil
+		idx.nframes = 0
+		idx.spf = 0
+	}
+	if nframes <= idx.nframes {
+		return nil
+	}
+	if idx.spf == 0 {
+		spf, err := GD_spf_checked(df, idx.fieldName)
+		if err != nil {
+			return err
+		}
+		idx.spf = spf
+		if idx.spf == 0 {
+			return fmt.Errorf("time field %s has no samples per frame", idx.fieldName)
+		}
+	}
+
+	sample := make([]float64, 1)
+	indexed := nframes
+	for frame := len(idx.times) * timeIndexStride; frame < nframes; frame += timeIndexStride {
+		if ctx.Err() != nil {
+			//whatever we got so far is still good, the rest gets read next time
+			return fmt.Errorf("indexing %s: %w", idx.fieldName, ctx.Err())
+		}
+		n, err := GD_getdata_c(idx.fieldName, df, frame, 0, 0, 1, sample)
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			// the frame is there but the field did not get written yet, try again next time
+			indexed = frame
+			break
+		}
+		idx.times = append(idx.times, sample[0])
+	}
+	idx.nframes = indexed
+	return nil
+}
+
+// lookup finds the fractional frame at which the time field crosses value
+// values before the start of the data give 0 and values after the end give nframes
+func (idx *timeIndex) lookup(ctx context.Context, df Dirfile, value float64) (float64, error) {
+	defer idx.mutex.Unlock()
+	idx.mutex.Lock()
+
+	err := idx.refresh(ctx, df)
+	if err != nil {
+		return 0, err
+	}
+	if len(idx.times) == 0 {
+		return 0, fmt.Errorf("time field %s is empty: %w", idx.fieldName, ErrRange)
+	}
+	// the block we want starts at the last entry before the value
+	block := searchIndex(idx.times, value)
+	if block < 0 {
+		return 0, nil
+	}
+	firstFrame := block * timeIndexStride
+	numFrames := timeIndexStride
+	if firstFrame+numFrames > idx.nframes {
+		numFrames = idx.nframes - firstFrame
+	}
+
+	samples := make([]float64, numFrames*idx.spf)
+	n, err := GD_getdata_c(idx.fieldName, df, firstFrame, 0, numFrames, 0, samples)
+	if err != nil {
+		return 0, err
+	}
+
+	frame, found := searchBlock(samples[:n], value, firstFrame, idx.spf)
+	if !found {
+		if block == len(idx.times)-1 {
+			// past the last sample in the dirfile
+			return float64(idx.nframes), nil
+		}
+		// the next entry in the index is the answer
+		return float64(firstFrame + numFrames), nil
+	}
+	return frame, nil
+}
+
+// searchIndex gives the block of the sparse index in which the time field crosses value, the one
+// starting at the last entry before value. -1 when value is at or before the very first sample
+func searchIndex(times []float64, value float64) int {
+	if len(times) == 0 || value <= times[0] {
+		return -1
+	}
+	return sort.SearchFloat64s(times, value) - 1
+}
+
+// searchBlock finds the fractional frame at which the samples of a block starting at firstFrame
+// reach value, interpolating linearly between the samples either side like gd_framenum does.
+// found is false when every sample of the block is below value
+func searchBlock(samples []float64, value float64, firstFrame, spf int) (frame float64, found bool) {
+	// position of the first sample which is >= value inside the block
+	i := sort.SearchFloat64s(samples, value)
+	if i >= len(samples) {
+		return 0, false
+	}
+	if i == 0 || samples[i] == samples[i-1] {
+		return float64(firstFrame) + float64(i)/float64(spf), true
+	}
+	fraction := (value - samples[i-1]) / (samples[i] - samples[i-1])
+	return float64(firstFrame) + (float64(i-1)+fraction)/float64(spf), true
+}
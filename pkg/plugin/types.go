@@ -3,18 +3,45 @@ package plugin
 import "time"
 
 type InitSettings struct {
-	DatabaseLocation string `json:"path"` //this specifies how to unmarshal
+	DatabaseLocation            string  `json:"path"`                        //this specifies how to unmarshal
+	PyramidMemoryMB             int     `json:"pyramidMemoryMB"`             //memory for decimation pyramids, 0 for the default and negative to turn them off
+	BlockCacheMB                int     `json:"blockCacheMB"`                //memory for recently read blocks, 0 for the default and negative to turn it off
+	MaxConcurrentQueries        int     `json:"maxConcurrentQueries"`        //number of dirfile handles and so of queries running at once
+	QueryTimeoutSeconds         float64 `json:"queryTimeoutSeconds"`         //queries taking longer than this get cancelled, 0 for no timeout
+	MaxSamples                  int     `json:"maxSamples"`                  //raw reads bigger than this get refused, 0 for no limit
+	PrettyPrint                 bool    `json:"prettyPrint"`                 //GD_PRETTY_PRINT
+	IgnoreDuplicates            bool    `json:"ignoreDuplicates"`            //GD_IGNORE_DUPS, dont fail on duplicate field names in the format file
+	Encoding                    string  `json:"encoding"`                    //force an encoding (none, gzip, bzip2, ...), empty or auto to let getdata figure it out
+	Verbose                     bool    `json:"verbose"`                     //GD_VERBOSE, getdata prints parser errors to the plugin log
+	DefaultTimeField            string  `json:"defaultTimeField"`            //time field the health check reports the covered time range of, and the time field used when a query has none
+	DefaultTimeFormat           string  `json:"defaultTimeFormat"`           //encoding of the default time field, same values as TimeFormat in the query
+	SampleRateField             string  `json:"sampleRateField"`             //CONST entry holding the frame rate, used when a query has no sample rate
+	LeapSecondsFile             string  `json:"leapSecondsFile"`             //newer leap-seconds.list than the one built in, e.g. /usr/share/zoneinfo/leap-seconds.list
+	AnnotationsLocation         string  `json:"annotationsLocation"`         //writable dirfile published annotations go to, created if missing
+	AllowPublish                bool    `json:"allowPublish"`                //lets users publish annotations at all, off by default
+	PublishRole                 string  `json:"publishRole"`                 //lowest Grafana role allowed to publish: Viewer, Editor (default) or Admin
+	StreamSamplesPerSecond      int     `json:"streamSamplesPerSecond"`      //values a single stream may send per second, 0 for no limit
+	StreamBytesPerSecond        int     `json:"streamBytesPerSecond"`        //bytes a single stream may send per second, 0 for no limit
+	TotalStreamSamplesPerSecond int     `json:"totalStreamSamplesPerSecond"` //same for all the streams of the datasource together
+	TotalStreamBytesPerSecond   int     `json:"totalStreamBytesPerSecond"`
 }
 
 type QueryModel struct {
-	FieldName           string  `json:"fieldName"`
-	TimeName            string  `json:"timeName"`
-	StreamingBool       bool    `json:"streamingBool"`
-	IndexTimeOffsetType string  `json:"indexTimeOffsetType"`
-	IndexTimeOffset     int64   `json:"indexTimeOffset"`
-	SampleRate          float64 `json:"sampleRate"`
-	IndexByIndex        bool    `json:"indexByIndex"`
-	TimeType            bool    `json:"timeType"`
+	FieldName           string   `json:"fieldName"`
+	TimeName            string   `json:"timeName"`
+	StreamingBool       bool     `json:"streamingBool"`
+	IndexTimeOffsetType string   `json:"indexTimeOffsetType"`
+	IndexTimeOffset     int64    `json:"indexTimeOffset"`
+	SampleRate          float64  `json:"sampleRate"`
+	IndexByIndex        bool     `json:"indexByIndex"`
+	TimeType            bool     `json:"timeType"`
+	DecimationMode      string   `json:"decimationMode"` //pick (default), mean, min or max
+	TimeShift           string   `json:"timeShift"`      //show data from this long ago (1h, 1d, ...) on the current time range
+	TimeOffset          float64  `json:"timeOffset"`     //seconds added to the time field to correct a known clock offset
+	TimeFormat          string   `json:"timeFormat"`     //encoding of the time field: unix (default), unix_ms, unix_us, unix_ns, gps, mjd or tai
+	Interpolation       string   `json:"interpolation"`  //how the time field is read between its samples: linear (default), nearest or hold
+	FieldNames          []string `json:"fieldNames"`     //more fields sharing the time column with FieldName in one frame
+	StatsWindow         float64  `json:"statsWindow"`    //stream rolling statistics over this many seconds instead of the samples, 0 for samples
 }
 
 type AutocompleteRequest struct {
@@ -25,11 +52,63 @@ type AutocompleteResponse struct {
 	MatchList []string
 }
 
+type CacheStats struct {
+	Hits          int `json:"hits"`
+	Misses        int `json:"misses"`
+	Invalidations int `json:"invalidations"`
+	Evictions     int `json:"evictions"`
+	Bypasses      int `json:"bypasses"` //reads too big for the cache which went straight to getdata
+	Blocks        int `json:"blocks"`
+	Bytes         int `json:"bytes"`
+	BudgetBytes   int `json:"budgetBytes"`
+}
+
+type HealthDetails struct {
+	Path                string     `json:"path"`
+	GetdataBuildVersion string     `json:"getdataBuildVersion"` //of the getdata headers the plugin was built against, getdata has no way to ask the library at run time
+	StandardsVersion    int        `json:"standardsVersion"`
+	Fields              int        `json:"fields"`
+	Fragments           int        `json:"fragments"`
+	Frames              int        `json:"frames"`
+	TimeField           string     `json:"timeField,omitempty"`
+	TimeStart           *time.Time `json:"timeStart,omitempty"`
+	TimeEnd             *time.Time `json:"timeEnd,omitempty"`
+	Growing             *bool      `json:"growing,omitempty"` //frames went up since the last look, unknown on the first one
+	LeapSecondsUntil    time.Time  `json:"leapSecondsUntil"`
+	Warnings            []string   `json:"warnings"`
+}
+
 type StreamRequest struct {
-	fieldName     string
-	timeNameField string
-	timeName      string
-	interval      time.Duration
-	timeType      bool
-	sampleRate    float64
+	fieldName      string
+	timeNameField  string
+	timeName       string
+	interval       time.Duration
+	timeType       bool
+	sampleRate     float64 //frames per second of index based queries, 0 otherwise
+	timeOffset     float64
+	timeFormat     string
+	fieldNames     []string //more fields sent in the same frame as fieldName
+	interpolation  string
+	decimationMode string
+	factor         int     //samples per point the query decimated by, 0 to work it out from the interval
+	start          int     //sample the stream starts decimating at, where the query stopped on a bucket boundary. 0 for the end of the dirfile
+	statsWindow    float64 //seconds, or units of the time field when it is not a time. 0 for a stream of samples
+	indexMode      string  //index offset type the times come from when the time field is INDEX, empty to use the time field as is
+	indexStart     float64 //unix time of frame 0 for the fromStart and fromEnd index modes
+}
+
+// StreamResume is what a subscriber can send along when subscribing to pick up where it left off
+// after a reconnect, the frames written in between are sent to it before the live updates
+type StreamResume struct {
+	LastFrame *int     `json:"lastFrame,omitempty"` //last frame it got
+	LastTime  *float64 `json:"lastTime,omitempty"`  //or the x value of the last point it got, unix ms for time typed streams
+}
+
+// PublishRequest is what gets published on the annotations channel, either a number
+// appended to a RAW field (flags, setpoints) or a comment stored as a STRING entry
+type PublishRequest struct {
+	Field string   `json:"field"`
+	Value *float64 `json:"value,omitempty"`
+	Text  string   `json:"text,omitempty"`
+	Time  *float64 `json:"time,omitempty"` //unix seconds, now when not given
 }
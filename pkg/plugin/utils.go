@@ -1,36 +1,18 @@
 package plugin
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"math"
-	"strconv"
-	"strings"
 	"time"
-
-	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
-func decimate(data []float64, decimationFactor int) []float64 {
-	if decimationFactor > len(data) {
-		decimationFactor = len(data)
-	}
-	resultSize := int(len(data) / int(decimationFactor))
-	dataTmp := make([]float64, resultSize)
-
-	for i := 0; i < resultSize*decimationFactor; i++ {
-		if i%int(decimationFactor) == 0 {
-			dataTmp[int(i/int(decimationFactor))] = data[i]
-		}
-	}
-	return dataTmp
-}
-
-func unixSlice2TimeSlice(unixTimeSlice []float64) []time.Time {
+func unixSlice2TimeSlice(unixTimeSlice []float64, offset float64) []time.Time {
 	timeSlice := make([]time.Time, len(unixTimeSlice))
 
 	//loop through the ctimes and turn them into time objects
+	//offset (seconds) gets added first, it covers clock corrections and time shifts
 	for i, c_time := range unixTimeSlice {
+		c_time += offset
 		timeSlice[i] = time.Unix(int64(c_time), int64(math.Mod(c_time, 1)*1e9))
 	}
 	return timeSlice
@@ -51,30 +33,36 @@ func indexSlice2TimeSlice(indexSlice []float64, sampleRate float64, lastTime tim
 
 }
 
-func upsample(data []float64, upsampleFactor int) ([]float64, error) {
-	if len(data) < 2 {
-		backend.Logger.Info("data length must be at least 2 to upsample")
-		return nil, errors.New("data length must be at least 2 to upsample")
+// indexStart is the unix time of frame 0 for the fromStart and fromEnd index offset types. fromEnd counts back
+// from the frames there are when the query runs, so a stream keeps the same time axis as the dirfile grows
+func indexStart(offsetType string, offset, sampleRate float64, nframes int) float64 {
+	if offsetType == "fromEnd" {
+		return offset - float64(nframes)/sampleRate
 	}
-	dataUpsampled := make([]float64, len(data)*upsampleFactor)
-	jdx := -1
-	for idx := 0; idx < len(dataUpsampled); idx++ {
-		i := idx % upsampleFactor
-		if i == 0 {
-			jdx++
-			dataUpsampled[idx] = data[jdx]
-		} else {
-			t := float64(i) / float64(upsampleFactor)
-			if jdx == len(data)-1 {
-				// backend.Logger.Info("upsampling last point")
-				// backend.Logger.Info(fmt.Sprintf("len(dataUpsampled): %v, len(data): %v, jdx: %v, idx: %v", len(dataUpsampled), len(data), jdx, idx))
-				dataUpsampled[idx] = data[jdx] + (data[jdx]-data[jdx-1])*t
-			} else {
-				dataUpsampled[idx] = data[jdx]*(1-t) + data[jdx+1]*(t)
-			}
-		}
+	return offset
+}
+
+// indexTimes turns INDEX values into times for an index offset type. fromEndNow puts the last
+// one at lastTime, the others count from frame 0 at start
+func indexTimes(offsetType string, indexSlice []float64, sampleRate, start float64, lastTime time.Time) []time.Time {
+	if offsetType == "fromEndNow" {
+		return indexSlice2TimeSlice(indexSlice, sampleRate, lastTime)
 	}
-	return dataUpsampled, nil
+	timeSlice := make([]time.Time, len(indexSlice))
+	for i, index := range indexSlice {
+		timeFloat := start + index/sampleRate
+		timeSlice[i] = time.Unix(int64(timeFloat), int64(math.Mod(timeFloat, 1)*1e9))
+	}
+	return timeSlice
+}
+
+// isIndexOffsetType says if the index offset type is one query knows how to select frames with
+func isIndexOffsetType(offsetType string) bool {
+	switch offsetType {
+	case "fromStart", "fromEnd", "fromEndNow":
+		return true
+	}
+	return false
 }
 
 func compatibleDecimationFactor(decimationFactor int, spf int) int {
@@ -92,42 +80,48 @@ func compatibleDecimationFactor(decimationFactor int, spf int) int {
 
 }
 
-func encodeChan(UID, fieldName, interval, timeName string, timeType bool, sampleRateSend float64) string {
-	channelName := fmt.Sprintf("ds/%s/steam/%s/%s/%s/%t/%.3f", UID, fieldName, interval, timeName, timeType, sampleRateSend)
-	return channelName
+// span of samples to read for a fractional frame range, for the time field and a data field
+type sampleSpan struct {
+	timeFirst, timeNum int
+	dataFirst, dataNum int
 }
 
-func decodeChan(path string) (sr StreamRequest, err error) {
-	// var sr StreamRequest
-	// var err error
-	// get the name of the name of the field, held in path as stream/NameOfField
-	chunks := strings.Split(path, "/")
-	sr.fieldName = chunks[1]
-	sr.timeNameField = chunks[3]
-	sr.timeName = strings.Split(sr.timeNameField, "__")[0]
-	sr.interval, err = time.ParseDuration(chunks[2])
-	if err != nil {
-		return
+// newSampleSpan covers frames [f0, f1) with the samples of the time field plus one sample of slack either side,
+// so the ends can be trimmed by time afterwards. the data field gets the samples covering the same stretch
+// so the time and the data still line up sample for sample like whole frame reads do
+func newSampleSpan(f0, f1 float64, timeSpf, dataSpf, nframes int) sampleSpan {
+	timeTotal := nframes * timeSpf
+	timeFirst := int(math.Floor(f0 * float64(timeSpf)))
+	timeEnd := int(math.Ceil(f1*float64(timeSpf))) + 1
+	if timeEnd > timeTotal {
+		timeEnd = timeTotal
 	}
-	sr.timeType, err = strconv.ParseBool(chunks[4])
-	if err != nil {
-		return
+	//upsampling the time needs at least two points
+	if timeEnd-timeFirst < 2 {
+		timeFirst = timeEnd - 2
 	}
-	sr.sampleRate, err = strconv.ParseFloat(chunks[5], 64)
-	if err != nil {
-		return
+	if timeFirst < 0 {
+		timeFirst = 0
+	}
+
+	dataFirst := timeFirst * dataSpf / timeSpf
+	dataEnd := (timeEnd*dataSpf + timeSpf - 1) / timeSpf
+	if dataEnd > nframes*dataSpf {
+		dataEnd = nframes * dataSpf
 	}
-	return
+	return sampleSpan{timeFirst: timeFirst, timeNum: timeEnd - timeFirst, dataFirst: dataFirst, dataNum: dataEnd - dataFirst}
 }
 
-func getdata_double(df Dirfile, timeName string, fieldName string, firstFrame int, numFrames int) ([]float64, []float64, error) {
-	// grab the data and error check
-	dataSlice, err := GD_getdata(fieldName, df, int(firstFrame), numFrames)
+// getdata_double_samples is getdata_double for a sample accurate span
+// both slices come from the buffer pool, hand them back with putBuffer once done with them
+func getdata_double_samples(ctx context.Context, df Dirfile, cache *blockCache, timeName string, fieldName string, span sampleSpan) ([]float64, []float64, error) {
+	dataSlice, err := cache.getsamples(ctx, df, fieldName, span.dataFirst, span.dataNum, getBuffer(span.dataNum))
 	if err != nil {
 		return nil, nil, err
 	}
-	unixTimeSlice, err := GD_getdata(timeName, df, int(firstFrame), numFrames)
+	unixTimeSlice, err := cache.getsamples(ctx, df, timeName, span.timeFirst, span.timeNum, getBuffer(span.timeNum))
 	if err != nil {
+		putBuffer(dataSlice)
 		return nil, nil, err
 	}
 	return dataSlice, unixTimeSlice, nil
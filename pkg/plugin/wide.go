@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// fields gives every field the query asks for, FieldName first, without repeats
+func (qm QueryModel) fields() []string {
+	fields := []string{qm.FieldName}
+	seen := map[string]bool{qm.FieldName: true}
+	for _, name := range qm.FieldNames {
+		if name != "" && !seen[name] {
+			fields = append(fields, name)
+			seen[name] = true
+		}
+	}
+	return fields
+}
+
+// getdata_wide reads several fields against the time samples [timeFirst, timeFirst+timeNum)
+// the time field is read once and every field is sampled at the time samples, so they all share the time column
+// fields faster than the time field get the summary of their samples per time sample instead when decimation is
+// mean, min or max, interpolating would drop the samples in between before they are decimated
+func getdata_wide(ctx context.Context, df Dirfile, cache *blockCache, timeName string, fieldNames []string, timeFirst, timeNum int, mode, decimationMode string) ([]float64, [][]float64, error) {
+	nframes := GD_nframes(df)
+	timeSpf, err := GD_spf_checked(df, timeName)
+	if err != nil {
+		return nil, nil, err
+	}
+	times, err := cache.getsamples(ctx, df, timeName, timeFirst, timeNum, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns := make([][]float64, len(fieldNames))
+	for k, name := range fieldNames {
+		spf, err := GD_spf_checked(df, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		//the data samples around the first and the last time sample
+		first := timeFirst * spf / timeSpf
+		end := ((timeFirst+len(times))*spf+timeSpf-1)/timeSpf + 1
+		if end > nframes*spf {
+			end = nframes * spf
+		}
+		if end <= first {
+			columns[k] = resampleValues(nil, first, spf, timeFirst, timeSpf, len(times), mode)
+			continue
+		}
+		buf, err := cache.getsamples(ctx, df, name, first, end-first, getBuffer(end-first))
+		if err != nil {
+			return nil, nil, err
+		}
+		if summarisesValues(spf, timeSpf, decimationMode) {
+			columns[k] = summariseValues(buf, first, spf, timeFirst, timeSpf, len(times), decimationMode)
+		} else {
+			columns[k] = resampleValues(buf, first, spf, timeFirst, timeSpf, len(times), mode)
+		}
+		putBuffer(buf)
+	}
+	return times, columns, nil
+}
+
+// trimColumns drops the samples whose time is outside [from, to], time is in whatever the time field stores
+// the data columns line up one to one with the time column. it returns where the samples kept start
+// a range narrower than a sample keeps the one sample in it, or none
+func trimColumns(times []float64, columns [][]float64, from, to float64) (int, []float64, [][]float64) {
+	first := sort.Search(len(times), func(i int) bool { return times[i] >= from })
+	end := sort.Search(len(times), func(i int) bool { return times[i] > to })
+	if end < first {
+		end = first
+	}
+	for k := range columns {
+		columns[k] = columns[k][first:end]
+	}
+	return first, times[first:end], columns
+}
+
+// decimateFrom decimates the samples numbered from first on down to at most maxPoints points
+// the buckets are lined up on the sample numbers the same way a stream decimates, see decimator
+func decimateFrom(first int, times []float64, columns [][]float64, maxPoints int64, mode string) ([]float64, [][]float64) {
+	return decimateBy(first, times, columns, decimationFactor(first, len(times), maxPoints), mode)
+}
+
+// decimationFactor is the smallest factor which gets the n samples numbered from first on down to at most maxPoints points
+func decimationFactor(first, n int, maxPoints int64) int {
+	if maxPoints <= 0 || maxPoints >= int64(n) {
+		return 1
+	}
+	factor := int(math.Ceil(float64(n) / float64(maxPoints)))
+	//lining the buckets up can cost a point at either end
+	for int64((first+n-1)/factor-first/factor+1) > maxPoints {
+		factor++
+	}
+	return factor
+}
+
+// streamDecimationFactor is the factor a query decimates by and hands on to its stream. buckets
+// are a divisor or a multiple of a frame so a stream can resume from the frame a bucket starts in
+// this can leave a point or so more than maxPoints
+func streamDecimationFactor(first, n int, maxPoints int64, spf int) int {
+	factor := decimationFactor(first, n, maxPoints)
+	if factor == 1 || spf <= 0 {
+		return factor
+	}
+	return compatibleDecimationFactor(factor, spf)
+}
+
+// decimateBy decimates the samples numbered from first on by factor, the last bucket may be partial
+// the points are written over the start of times and columns so a query decimates in the buffers it read into.
+// the buckets line up like the ones of a decimator, point p only depends on samples from the p-th bucket on
+// so writing it never clobbers a sample still to be summarised
+func decimateBy(first int, times []float64, columns [][]float64, factor int, mode string) ([]float64, [][]float64) {
+	if factor <= 1 {
+		return times, columns
+	}
+	points := 0
+	for i := 0; i < len(times); points++ {
+		//the rest of the bucket the sample is in, or of what we have of it
+		end := ((first+i)/factor+1)*factor - first
+		if end > len(times) {
+			end = len(times)
+		}
+		times[points] = times[i]
+		for _, column := range columns {
+			column[points] = summarise(column[i:end]).value(mode)
+		}
+		i = end
+	}
+	for k := range columns {
+		columns[k] = columns[k][:points]
+	}
+	return times[:points], columns
+}
+
+// queryWide is the part of query reading several fields into one wide frame
+// the pyramid is not used, it keeps its own time per field. it also gives the decimation
+// factor in samples of the time field and the time sample after the last one read, for the stream
+func (d *Datasource) queryWide(ctx context.Context, df Dirfile, qm QueryModel, fields []string, firstFrame, endFrame float64, nframes int, rawFrom, rawTo float64, maxDataPoints int64) ([]float64, [][]float64, int, int, error) {
+	timeSpf, err := GD_spf_checked(df, qm.TimeName)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	span := newSampleSpan(firstFrame, endFrame, timeSpf, timeSpf, nframes)
+
+	if d.settings.MaxSamples > 0 {
+		samples := span.timeNum
+		for _, name := range fields {
+			samples += span.timeNum * GD_spf(df, name) / timeSpf
+		}
+		if samples > d.settings.MaxSamples {
+			return nil, nil, 0, 0, fmt.Errorf("query would read %d samples which is more than the limit of %d, try a shorter time range: %w", samples, d.settings.MaxSamples, ErrInvalidRequest)
+		}
+	}
+
+	times, columns, err := getdata_wide(ctx, df, d.blocks, qm.TimeName, fields, span.timeFirst, span.timeNum, qm.Interpolation, qm.DecimationMode)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	first := span.timeFirst
+	if !qm.IndexByIndex {
+		var cut int
+		cut, times, columns = trimColumns(times, columns, rawFrom, rawTo)
+		first += cut
+	}
+	//the factor comes from the whole span, trimming only ever leaves fewer samples
+	factor := streamDecimationFactor(span.timeFirst, span.timeNum, maxDataPoints, timeSpf)
+	end := first + len(times)
+	times, columns = decimateBy(first, times, columns, factor, qm.DecimationMode)
+	return times, columns, factor, end, nil
+}
@@ -1,18 +1,64 @@
 import React, { ChangeEvent } from 'react';
-import { InlineField, Input, SecretInput } from '@grafana/ui';
-import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
+import { FieldSet, InlineField, InlineSwitch, Input, SecretInput, Select } from '@grafana/ui';
+import { DataSourcePluginOptionsEditorProps, SelectableValue } from '@grafana/data';
 import { MyDataSourceOptions, MySecureJsonData } from '../types';
 
 interface Props extends DataSourcePluginOptionsEditorProps<MyDataSourceOptions> {}
 
+type StringOption = 'path' | 'defaultTimeField' | 'sampleRateField' | 'leapSecondsFile' | 'annotationsLocation';
+type NumberOption =
+  | 'pyramidMemoryMB'
+  | 'blockCacheMB'
+  | 'maxConcurrentQueries'
+  | 'queryTimeoutSeconds'
+  | 'maxSamples'
+  | 'streamSamplesPerSecond'
+  | 'streamBytesPerSecond'
+  | 'totalStreamSamplesPerSecond'
+  | 'totalStreamBytesPerSecond';
+type BoolOption = 'prettyPrint' | 'ignoreDuplicates' | 'verbose' | 'allowPublish';
+
+const encodings: Array<SelectableValue<string>> = [
+  { label: 'Auto', value: 'auto', description: 'Let getdata figure it out' },
+  { label: 'None', value: 'none' },
+  { label: 'Text', value: 'text' },
+  { label: 'Slim', value: 'slim' },
+  { label: 'Gzip', value: 'gzip' },
+  { label: 'Bzip2', value: 'bzip2' },
+  { label: 'LZMA', value: 'lzma' },
+  { label: 'SIE', value: 'sie' },
+  { label: 'Zzip', value: 'zzip' },
+  { label: 'Zzslim', value: 'zzslim' },
+  { label: 'FLAC', value: 'flac' },
+];
+
+const timeFormats: Array<SelectableValue<string>> = [
+  { label: 'Unix s', value: 'unix' },
+  { label: 'Unix ms', value: 'unix_ms' },
+  { label: 'Unix us', value: 'unix_us' },
+  { label: 'Unix ns', value: 'unix_ns' },
+  { label: 'GPS', value: 'gps', description: 'Seconds since 1980-01-06, no leap seconds' },
+  { label: 'MJD', value: 'mjd', description: 'UTC Modified Julian Date' },
+  { label: 'TAI', value: 'tai', description: 'Seconds since 1970 including the leap seconds' },
+];
+
+const publishRoles: Array<SelectableValue<string>> = [
+  { label: 'Viewer', value: 'Viewer' },
+  { label: 'Editor', value: 'Editor' },
+  { label: 'Admin', value: 'Admin' },
+];
+
 export function ConfigEditor(props: Props) {
   const { onOptionsChange, options } = props;
-  const onPathChange = (event: ChangeEvent<HTMLInputElement>) => {
-    const jsonData = {
-      ...options.jsonData,
-      path: event.target.value,
-    };
-    onOptionsChange({ ...options, jsonData });
+
+  const setOption = (key: keyof MyDataSourceOptions, value: string | number | boolean | undefined) => {
+    onOptionsChange({ ...options, jsonData: { ...options.jsonData, [key]: value } });
+  };
+
+  // empty means the backend default, which is also what 0 means for all of these
+  const numberValue = (event: ChangeEvent<HTMLInputElement>) => {
+    const value = parseFloat(event.target.value);
+    return isNaN(value) ? undefined : value;
   };
 
   // Secure field (only sent to the backend)
@@ -42,26 +88,139 @@ export function ConfigEditor(props: Props) {
   const { jsonData, secureJsonFields } = options;
   const secureJsonData = (options.secureJsonData || {}) as MySecureJsonData;
 
+  const textField = (key: StringOption, label: string, tooltip: string, placeholder = '') => (
+    <InlineField label={label} labelWidth={28} tooltip={tooltip}>
+      <Input
+        onChange={(event: ChangeEvent<HTMLInputElement>) => setOption(key, event.target.value)}
+        value={jsonData[key] || ''}
+        placeholder={placeholder}
+        width={40}
+      />
+    </InlineField>
+  );
+
+  const numberField = (key: NumberOption, label: string, tooltip: string, placeholder: string) => (
+    <InlineField label={label} labelWidth={28} tooltip={tooltip}>
+      <Input
+        type="number"
+        onChange={(event: ChangeEvent<HTMLInputElement>) => setOption(key, numberValue(event))}
+        value={jsonData[key] ?? ''}
+        placeholder={placeholder}
+        width={20}
+      />
+    </InlineField>
+  );
+
+  const switchField = (key: BoolOption, label: string, tooltip: string) => (
+    <InlineField label={label} labelWidth={28} tooltip={tooltip}>
+      <InlineSwitch
+        value={jsonData[key] || false}
+        onChange={(event: React.FormEvent<HTMLInputElement>) => setOption(key, event.currentTarget.checked)}
+      />
+    </InlineField>
+  );
+
   return (
     <div className="gf-form-group">
-      <InlineField label="Path" labelWidth={12}>
-        <Input
-          onChange={onPathChange}
-          value={jsonData.path || ''}
-          placeholder="json field returned to frontend"
-          width={40}
-        />
-      </InlineField>
-      <InlineField label="API Key" labelWidth={12}>
-        <SecretInput
-          isConfigured={(secureJsonFields && secureJsonFields.apiKey) as boolean}
-          value={secureJsonData.apiKey || ''}
-          placeholder="secure json field (backend only)"
-          width={40}
-          onReset={onResetAPIKey}
-          onChange={onAPIKeyChange}
-        />
-      </InlineField>
+      <FieldSet label="Dirfile">
+        {textField('path', 'Path', 'Path of the dirfile to read', '/data/dirfile')}
+        <InlineField label="API Key" labelWidth={28}>
+          <SecretInput
+            isConfigured={(secureJsonFields && secureJsonFields.apiKey) as boolean}
+            value={secureJsonData.apiKey || ''}
+            placeholder="secure json field (backend only)"
+            width={40}
+            onReset={onResetAPIKey}
+            onChange={onAPIKeyChange}
+          />
+        </InlineField>
+        {textField(
+          'defaultTimeField',
+          'Default time field',
+          'Time field new queries start with and the health check reports the time range of',
+          'TIME'
+        )}
+        <InlineField label="Default time format" labelWidth={28} tooltip="What the default time field holds">
+          <Select
+            options={timeFormats}
+            value={jsonData.defaultTimeFormat || 'unix'}
+            onChange={(v: SelectableValue<string>) => setOption('defaultTimeFormat', v.value)}
+            width={20}
+          />
+        </InlineField>
+        {textField(
+          'sampleRateField',
+          'Sample rate field',
+          'CONST entry holding the frame rate, used by index queries without a sample rate'
+        )}
+        {textField(
+          'leapSecondsFile',
+          'Leap seconds file',
+          'Newer leap-seconds.list than the one built in, for gps and tai time fields',
+          '/usr/share/zoneinfo/leap-seconds.list'
+        )}
+      </FieldSet>
+
+      <FieldSet label="Opening">
+        <InlineField label="Encoding" labelWidth={28} tooltip="Force the encoding of the raw fields">
+          <Select
+            options={encodings}
+            value={jsonData.encoding || 'auto'}
+            onChange={(v: SelectableValue<string>) => setOption('encoding', v.value)}
+            width={20}
+          />
+        </InlineField>
+        {switchField('prettyPrint', 'Pretty print', 'Open with GD_PRETTY_PRINT')}
+        {switchField('ignoreDuplicates', 'Ignore duplicates', 'Do not fail on duplicate field names in the format files')}
+        {switchField('verbose', 'Verbose', 'getdata prints format file errors to the plugin log')}
+      </FieldSet>
+
+      <FieldSet label="Limits">
+        {numberField(
+          'maxConcurrentQueries',
+          'Max concurrent queries',
+          'Dirfile handles, and so queries running at once',
+          '4'
+        )}
+        {numberField('queryTimeoutSeconds', 'Query timeout (s)', 'Queries taking longer get cancelled, 0 for no timeout', '0')}
+        {numberField('maxSamples', 'Max samples', 'Raw reads of more samples get refused, 0 for no limit', '0')}
+        {numberField(
+          'pyramidMemoryMB',
+          'Pyramid memory (MB)',
+          'Memory for the decimation pyramids, 0 for the default and negative to turn them off',
+          '64'
+        )}
+        {numberField(
+          'blockCacheMB',
+          'Block cache (MB)',
+          'Memory for recently read blocks, 0 for the default and negative to turn it off',
+          '32'
+        )}
+      </FieldSet>
+
+      <FieldSet label="Streams">
+        {numberField('streamSamplesPerSecond', 'Samples/s per stream', 'Values a single stream may send per second, 0 for no limit', '0')}
+        {numberField('streamBytesPerSecond', 'Bytes/s per stream', 'Bytes a single stream may send per second, 0 for no limit', '0')}
+        {numberField('totalStreamSamplesPerSecond', 'Samples/s all streams', 'Values all the streams together may send per second, 0 for no limit', '0')}
+        {numberField('totalStreamBytesPerSecond', 'Bytes/s all streams', 'Bytes all the streams together may send per second, 0 for no limit', '0')}
+      </FieldSet>
+
+      <FieldSet label="Annotations">
+        {textField(
+          'annotationsLocation',
+          'Annotations dirfile',
+          'Writable dirfile published annotations go to, created if missing'
+        )}
+        {switchField('allowPublish', 'Allow publishing', 'Let users publish annotations at all')}
+        <InlineField label="Publish role" labelWidth={28} tooltip="Lowest role allowed to publish">
+          <Select
+            options={publishRoles}
+            value={jsonData.publishRole || 'Editor'}
+            onChange={(v: SelectableValue<string>) => setOption('publishRole', v.value)}
+            width={20}
+          />
+        </InlineField>
+      </FieldSet>
     </div>
   );
 }
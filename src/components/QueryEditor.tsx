@@ -1,5 +1,5 @@
 import React, {useState } from 'react';
-import {InlineFormLabel, AsyncSelect, LoadOptionsCallback, Checkbox, Select, VerticalGroup, HorizontalGroup, DateTimePicker} from '@grafana/ui';
+import {InlineFormLabel, AsyncSelect, AsyncMultiSelect, LoadOptionsCallback, Checkbox, Select, VerticalGroup, HorizontalGroup, DateTimePicker, Input} from '@grafana/ui';
 import { QueryEditorProps, SelectableValue, dateTime } from '@grafana/data';
 import { DataSource } from '../datasource';
 import { MyDataSourceOptions, MyQuery } from '../types';
@@ -42,6 +42,35 @@ export function QueryEditor(props: Props) {
     "fromEndNow" : "From end now"
   }
 
+  const decimationModes: Array<SelectableValue<string>> = [
+    {label: "Pick", value: "pick", description: "First sample of each bucket"},
+    {label: "Mean", value: "mean"},
+    {label: "Min", value: "min"},
+    {label: "Max", value: "max"}
+  ]
+
+  const timeFormats: Array<SelectableValue<string>> = [
+    {label: "Unix s", value: "unix"},
+    {label: "Unix ms", value: "unix_ms"},
+    {label: "Unix us", value: "unix_us"},
+    {label: "Unix ns", value: "unix_ns"},
+    {label: "GPS", value: "gps", description: "Seconds since 1980-01-06, no leap seconds"},
+    {label: "MJD", value: "mjd", description: "UTC Modified Julian Date"},
+    {label: "TAI", value: "tai", description: "Seconds since 1970 including the leap seconds"}
+  ]
+
+  const interpolations: Array<SelectableValue<string>> = [
+    {label: "Linear", value: "linear"},
+    {label: "Nearest", value: "nearest"},
+    {label: "Hold", value: "hold"}
+  ]
+
+  //empty number inputs mean the default, which is 0 for all of them
+  const numberValue = (value: string) => {
+    const n = parseFloat(value);
+    return isNaN(n) ? undefined : n;
+  }
+
   const [timeName, setTimeName] = useState<SelectableValue<string>>({label: props.query.timeName, value: props.query.timeName});
   const [fieldName, setFieldName] = useState<SelectableValue<string>>({label: props.query.fieldName, value: props.query.fieldName});
   const [streamingBool, setStreamingBool] = useState<boolean>(props.query.streamingBool);
@@ -49,6 +78,7 @@ export function QueryEditor(props: Props) {
   const [indexByIndex, setIndexByIndex] = useState<boolean>(props.query.indexByIndex);
   const [indexTimeOffset, setIndexTimeOffset] = useState<number>(props.query.indexTimeOffset);
   const [timeType, setTimeType] = useState<boolean>(props.query.timeType);
+  const [fieldNames, setFieldNames] = useState<Array<SelectableValue<string>>>((props.query.fieldNames || []).map((name) => ({label: name, value: name})));
   return (
     <div className="gf-form">
       <VerticalGroup>
@@ -113,14 +143,15 @@ export function QueryEditor(props: Props) {
               props.onChange({ ...props.query, indexTimeOffsetType: v.value });
             }}
           />
-      <InlineFormLabel width={12} tooltip="">
+      <InlineFormLabel width={12} tooltip="Frames per second for INDEX queries, 0 reads it from the sample rate field or works it out from the time field">
         sample rate
       </InlineFormLabel>
       <input
         type="number"
         value={props.query.sampleRate}
+        placeholder="0 = auto"
         onChange={(e) => {
-          props.onChange({ ...props.query, sampleRate: parseFloat(e.currentTarget.value) });
+          props.onChange({ ...props.query, sampleRate: parseFloat(e.currentTarget.value) || 0 });
         }}
       />
       {/* <InlineFormLabel width={12} tooltip="">
@@ -138,6 +169,93 @@ export function QueryEditor(props: Props) {
       }}
     />
       </HorizontalGroup>
+      <HorizontalGroup>
+      <InlineFormLabel width={7} tooltip="More fields sharing the time column in the same frame">
+          More fields
+        </InlineFormLabel>
+        <AsyncMultiSelect
+          loadOptions={handleOptionFetch}
+          defaultOptions
+          value={fieldNames}
+          onChange={(v: Array<SelectableValue<string>>) => {
+            setFieldNames(v);
+            props.onChange({ ...props.query, fieldNames: v.map((o) => o.value as string) });
+            props.onRunQuery();
+          }}
+          allowCreateWhileLoading
+          openMenuOnFocus
+        />
+      <InlineFormLabel width={8} tooltip="How each bucket of samples becomes a point">
+          Decimation
+        </InlineFormLabel>
+          <Select
+            options={decimationModes}
+            value={props.query.decimationMode || "pick"}
+            onChange={(v: SelectableValue<string>) => {
+              props.onChange({ ...props.query, decimationMode: v.value });
+              props.onRunQuery();
+            }}
+            width={12}
+          />
+      <InlineFormLabel width={8} tooltip="What the time field holds">
+          Time format
+        </InlineFormLabel>
+          <Select
+            options={timeFormats}
+            value={props.query.timeFormat || "unix"}
+            onChange={(v: SelectableValue<string>) => {
+              props.onChange({ ...props.query, timeFormat: v.value });
+              props.onRunQuery();
+            }}
+            width={12}
+          />
+      <InlineFormLabel width={8} tooltip="How the time field is read between its samples">
+          Interpolation
+        </InlineFormLabel>
+          <Select
+            options={interpolations}
+            value={props.query.interpolation || "linear"}
+            onChange={(v: SelectableValue<string>) => {
+              props.onChange({ ...props.query, interpolation: v.value });
+              props.onRunQuery();
+            }}
+            width={12}
+          />
+      </HorizontalGroup>
+      <HorizontalGroup>
+      <InlineFormLabel width={7} tooltip="Show the data from this long ago (1h, 1d, 1w) on the current time range">
+          Time shift
+        </InlineFormLabel>
+        <Input
+          value={props.query.timeShift || ""}
+          placeholder="1d"
+          width={10}
+          onChange={(e) => props.onChange({ ...props.query, timeShift: e.currentTarget.value })}
+          onBlur={() => props.onRunQuery()}
+        />
+      <InlineFormLabel width={8} tooltip="Seconds added to the time field, for a clock with a known offset">
+          Time offset
+        </InlineFormLabel>
+        <Input
+          type="number"
+          value={props.query.timeOffset ?? ""}
+          placeholder="0"
+          width={10}
+          onChange={(e) => props.onChange({ ...props.query, timeOffset: numberValue(e.currentTarget.value) })}
+          onBlur={() => props.onRunQuery()}
+        />
+      <InlineFormLabel width={8} tooltip="Stream rolling statistics over this many seconds instead of the samples, empty for samples">
+          Stats window
+        </InlineFormLabel>
+        <Input
+          type="number"
+          value={props.query.statsWindow ?? ""}
+          placeholder="0"
+          width={10}
+          onChange={(e) => props.onChange({ ...props.query, statsWindow: numberValue(e.currentTarget.value) })}
+          onBlur={() => props.onRunQuery()}
+        />
+      </HorizontalGroup>
       </VerticalGroup>
       </div>
   );
@@ -4,11 +4,19 @@ import { DataSourceWithBackend } from '@grafana/runtime';
 import { MyQuery, MyDataSourceOptions, DEFAULT_QUERY } from './types';
 
 export class DataSource extends DataSourceWithBackend<MyQuery, MyDataSourceOptions> {
+  defaultTimeField?: string;
+  defaultTimeFormat?: string;
+
   constructor(instanceSettings: DataSourceInstanceSettings<MyDataSourceOptions>) {
     super(instanceSettings);
+    this.defaultTimeField = instanceSettings.jsonData.defaultTimeField;
+    this.defaultTimeFormat = instanceSettings.jsonData.defaultTimeFormat;
   }
 
   getDefaultQuery(_: CoreApp): Partial<MyQuery> {
+    if (this.defaultTimeField) {
+      return { ...DEFAULT_QUERY, timeName: this.defaultTimeField, timeFormat: this.defaultTimeFormat };
+    }
     return DEFAULT_QUERY
   }
 }
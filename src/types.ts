@@ -9,13 +9,20 @@ export interface MyQuery extends DataQuery {
   indexTimeOffset: number;
   sampleRate: number;
   timeType: boolean;
+  decimationMode?: string;
+  timeShift?: string;
+  timeOffset?: number;
+  timeFormat?: string;
+  interpolation?: string;
+  fieldNames?: string[];
+  statsWindow?: number;
 }
 
 export const DEFAULT_QUERY: Partial<MyQuery> = {
   timeName: "TIME",
   streamingBool: false,
   indexTimeOffsetType: "fromEndNow",
-  sampleRate: 6,
+  sampleRate: 0,
   indexTimeOffset: new Date().getUTCSeconds(),
   indexByIndex: false,
   timeType: true,
@@ -26,6 +33,26 @@ export const DEFAULT_QUERY: Partial<MyQuery> = {
  */
 export interface MyDataSourceOptions extends DataSourceJsonData {
   path?: string;
+  pyramidMemoryMB?: number;
+  blockCacheMB?: number;
+  maxConcurrentQueries?: number;
+  queryTimeoutSeconds?: number;
+  maxSamples?: number;
+  prettyPrint?: boolean;
+  ignoreDuplicates?: boolean;
+  encoding?: string;
+  verbose?: boolean;
+  defaultTimeField?: string;
+  defaultTimeFormat?: string;
+  sampleRateField?: string;
+  leapSecondsFile?: string;
+  annotationsLocation?: string;
+  allowPublish?: boolean;
+  publishRole?: string;
+  streamSamplesPerSecond?: number;
+  streamBytesPerSecond?: number;
+  totalStreamSamplesPerSecond?: number;
+  totalStreamBytesPerSecond?: number;
 }
 
 /**